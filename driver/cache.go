@@ -0,0 +1,332 @@
+package driver
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/libkv/store"
+)
+
+const cacheReplayInterval = 5 * time.Second
+
+// cacheStore is a read-through cache in front of the cluster store. Records
+// read or watched are kept in memory and served while the store is
+// unreachable, writes failing meanwhile are applied to the cache and queued
+// to be replayed in order once the store is back.
+type cacheStore struct {
+	store.Store
+
+	sync.Mutex
+	kvs     map[string][]byte
+	pending []*pendingWrite
+
+	// keyLocks serializes the writes of a key, so that writes failing
+	// concurrently are queued in the order they were made
+	keyLocks keyedMutex
+}
+
+// pendingWrite is a queued Put or Delete
+type pendingWrite struct {
+	key    string
+	value  []byte
+	delete bool
+}
+
+func newCacheStore(s store.Store, dirs ...string) *cacheStore {
+	cs := &cacheStore{
+		Store: s,
+		kvs:   map[string][]byte{},
+	}
+	for _, dir := range dirs {
+		cs.refresh(dir)
+		go cs.watch(dir)
+	}
+	go cs.replay()
+	return cs
+}
+
+// unreachable tells whether err means the store could not be reached, as
+// opposed to an answer of the store
+func unreachable(err error) bool {
+	switch err {
+	case nil, store.ErrKeyNotFound, store.ErrKeyModified, store.ErrKeyExists, store.ErrPreviousNotSpecified:
+		return false
+	}
+	return true
+}
+
+func (cs *cacheStore) Get(key string) (*store.KVPair, error) {
+	kv, err := cs.Store.Get(key)
+	if !unreachable(err) {
+		cs.Lock()
+		defer cs.Unlock()
+		if !cs.queued(key) {
+			if err == nil {
+				cs.kvs[key] = kv.Value
+			} else {
+				delete(cs.kvs, key)
+			}
+			return kv, err
+		}
+		// the store is back but misses the queued write yet
+		value, ok := cs.kvs[key]
+		if !ok {
+			return nil, store.ErrKeyNotFound
+		}
+		return &store.KVPair{Key: key, Value: value}, nil
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+	value, ok := cs.kvs[key]
+	if !ok {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"key": key, "err": err}).Warn("cluster store unreachable, read from cache")
+	return &store.KVPair{Key: key, Value: value}, nil
+}
+
+func (cs *cacheStore) Exists(key string) (bool, error) {
+	exists, err := cs.Store.Exists(key)
+	if !unreachable(err) {
+		return exists, err
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+	_, ok := cs.kvs[key]
+	return ok, nil
+}
+
+func (cs *cacheStore) List(directory string) ([]*store.KVPair, error) {
+	kvs, err := cs.Store.List(directory)
+	if !unreachable(err) {
+		if err != nil && err != store.ErrKeyNotFound {
+			return kvs, err
+		}
+		cs.update(directory, kvs)
+
+		cs.Lock()
+		defer cs.Unlock()
+		if kvs = cs.overlay(directory, kvs); len(kvs) == 0 {
+			return nil, store.ErrKeyNotFound
+		}
+		return kvs, nil
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+	kvs = []*store.KVPair{}
+	for key, value := range cs.kvs {
+		if strings.HasPrefix(key, directory+"/") {
+			kvs = append(kvs, &store.KVPair{Key: key, Value: value})
+		}
+	}
+	if len(kvs) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	logrus.WithFields(logrus.Fields{"directory": directory, "err": err}).Warn("cluster store unreachable, list from cache")
+	return kvs, nil
+}
+
+func (cs *cacheStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	// directories and ttl keys are meaningless once replayed, never queue them
+	if options != nil && (options.IsDir || options.TTL != 0) {
+		return cs.Store.Put(key, value, options)
+	}
+
+	// keep the order of writes, queue behind pending ones. The store is
+	// called without the lock, it may take long to give up on an outage.
+	defer cs.keyLocks.Lock(key)()
+	cs.Lock()
+	if len(cs.pending) > 0 {
+		defer cs.Unlock()
+		return cs.queuePut(key, value)
+	}
+	cs.Unlock()
+
+	err := cs.Store.Put(key, value, options)
+
+	cs.Lock()
+	defer cs.Unlock()
+	if !unreachable(err) {
+		if err == nil && !cs.queued(key) {
+			cs.kvs[key] = value
+		}
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"key": key, "err": err}).Warn("cluster store unreachable, queue put")
+	return cs.queuePut(key, value)
+}
+
+func (cs *cacheStore) Delete(key string) error {
+	defer cs.keyLocks.Lock(key)()
+	cs.Lock()
+	if len(cs.pending) > 0 {
+		defer cs.Unlock()
+		return cs.queueDelete(key)
+	}
+	cs.Unlock()
+
+	err := cs.Store.Delete(key)
+
+	cs.Lock()
+	defer cs.Unlock()
+	if !unreachable(err) {
+		if !cs.queued(key) {
+			delete(cs.kvs, key)
+		}
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"key": key, "err": err}).Warn("cluster store unreachable, queue delete")
+	return cs.queueDelete(key)
+}
+
+// queuePut applies a put of key to the cache and queues it, the lock must be
+// held
+func (cs *cacheStore) queuePut(key string, value []byte) error {
+	cs.kvs[key] = value
+	cs.pending = append(cs.pending, &pendingWrite{key: key, value: value})
+	return nil
+}
+
+// queueDelete applies a delete of key to the cache and queues it, the lock
+// must be held
+func (cs *cacheStore) queueDelete(key string) error {
+	if _, ok := cs.kvs[key]; !ok && !cs.queued(key) {
+		return store.ErrKeyNotFound
+	}
+	delete(cs.kvs, key)
+	cs.pending = append(cs.pending, &pendingWrite{key: key, delete: true})
+	return nil
+}
+
+// queued tells whether a write of key is still waiting to be replayed, the
+// cache then holds a newer record than the store
+func (cs *cacheStore) queued(key string) bool {
+	for _, w := range cs.pending {
+		if w.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// overlay replaces the records of kvs listed from directory with their
+// queued writes, and adds the queued records missing from kvs. The lock must
+// be held.
+func (cs *cacheStore) overlay(directory string, kvs []*store.KVPair) []*store.KVPair {
+	merged := make([]*store.KVPair, 0, len(kvs))
+	seen := map[string]bool{}
+	for _, kv := range kvs {
+		// zookeeper lists child names, other backends full keys
+		key := directory + "/" + path.Base(kv.Key)
+		if !cs.queued(key) {
+			merged = append(merged, kv)
+			continue
+		}
+		seen[key] = true
+		if value, ok := cs.kvs[key]; ok {
+			merged = append(merged, &store.KVPair{Key: kv.Key, Value: value})
+		}
+	}
+	for _, w := range cs.pending {
+		if seen[w.key] || !strings.HasPrefix(w.key, directory+"/") {
+			continue
+		}
+		seen[w.key] = true
+		if value, ok := cs.kvs[w.key]; ok {
+			merged = append(merged, &store.KVPair{Key: w.key, Value: value})
+		}
+	}
+	return merged
+}
+
+// update replaces the cached records under directory with kvs
+func (cs *cacheStore) update(directory string, kvs []*store.KVPair) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	for key := range cs.kvs {
+		if strings.HasPrefix(key, directory+"/") && !cs.queued(key) {
+			delete(cs.kvs, key)
+		}
+	}
+	for _, kv := range kvs {
+		// zookeeper lists child names, other backends full keys
+		key := directory + "/" + path.Base(kv.Key)
+		if !cs.queued(key) {
+			cs.kvs[key] = kv.Value
+		}
+	}
+}
+
+func (cs *cacheStore) refresh(directory string) {
+	kvs, err := cs.Store.List(directory)
+	if err != nil && err != store.ErrKeyNotFound {
+		logrus.WithFields(logrus.Fields{"directory": directory, "err": err}).Warn("cannot fill cache")
+		return
+	}
+	cs.update(directory, kvs)
+}
+
+// watch keeps the cached records of directory fresh, zookeeper only notifies
+// on created or deleted children, updated records are refreshed on read
+func (cs *cacheStore) watch(directory string) {
+	for {
+		if exists, _ := cs.Store.Exists(directory); !exists {
+			cs.Store.Put(directory, nil, &store.WriteOptions{IsDir: true})
+		}
+
+		ch, err := cs.Store.WatchTree(directory, nil)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"directory": directory, "err": err}).Debug("cannot watch cache directory, retry later")
+			time.Sleep(cacheReplayInterval)
+			continue
+		}
+
+		for kvs := range ch {
+			cs.update(directory, kvs)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// replay applies the queued writes in order once the store is reachable,
+// the lock is only held to take the next write and to drop it once applied
+func (cs *cacheStore) replay() {
+	for range time.Tick(cacheReplayInterval) {
+		for {
+			cs.Lock()
+			if len(cs.pending) == 0 {
+				cs.Unlock()
+				break
+			}
+			w := cs.pending[0]
+			cs.Unlock()
+
+			var err error
+			if !w.delete {
+				err = cs.Store.Put(w.key, w.value, nil)
+			} else if err = cs.Store.Delete(w.key); err == store.ErrKeyNotFound {
+				err = nil
+			}
+			if unreachable(err) {
+				break
+			}
+			if err != nil {
+				logrus.WithFields(logrus.Fields{"key": w.key, "err": err}).Warn("drop queued write")
+			} else {
+				logrus.WithField("key", w.key).Info("replay queued write")
+			}
+
+			// only replay takes writes off the queue, w is still its head
+			cs.Lock()
+			cs.pending = cs.pending[1:]
+			cs.Unlock()
+		}
+	}
+}
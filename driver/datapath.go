@@ -0,0 +1,588 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/omega/vlan-netplugin/nl"
+	"github.com/omega/vlan-netplugin/ovs"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	DatapathBridge     = "bridge"
+	DatapathVlanBridge = "vlan-bridge"
+	DatapathOvs        = "ovs"
+
+	// maxIfNameLen is IFNAMSIZ without the trailing nul
+	maxIfNameLen = 15
+)
+
+var (
+	errQinQNeedsBridge   = errors.New(`opt "OuterVlanId" needs the bridge datapath`)
+	errParentNeedsBridge = errors.New(`opt "Parent" needs the bridge datapath`)
+)
+
+// bridgeOnly fails for the vlans only the bridge datapath builds devices for,
+// the other datapaths trunk the default parent eth only
+func bridgeOnly(v Vlan) error {
+	if v.Outer != 0 {
+		return errQinQNeedsBridge
+	}
+	if v.Parent != "" {
+		return errParentNeedsBridge
+	}
+	return nil
+}
+
+func checkIfName(name string) error {
+	if len(name) > maxIfNameLen {
+		return fmt.Errorf("device name %q is longer than %d characters", name, maxIfNameLen)
+	}
+	return nil
+}
+
+// datapath connects the host side veth of an endpoint to its vlan on the parent eth,
+// Release tears down the devices of a vlan once no endpoint is connected to it.
+// Disconnect is given the zero Vlan when the vlan of a stale veth is unknown.
+// Devices lists the devices a veth of the vlan is attached to.
+// A vlan trunked by Trunk is undone by Disconnect and Rollback given the
+// name passed to Trunk instead of the veth.
+type datapath interface {
+	// Connect returns the devices it created, a failed Connect already
+	// removed them
+	Connect(v Vlan, veth netlink.Link) (created []string, err error)
+	Disconnect(v Vlan, veth string) error
+	// Rollback undoes a Connect of a failed join, it removes the veth and the
+	// created devices, unless another endpoint got connected to them meanwhile
+	Rollback(v Vlan, veth string, created []string) error
+	Release(v Vlan) error
+	Devices(v Vlan) []string
+	// Connected tells whether veth is connected to v already, Reconcile
+	// leaves such a veth alone
+	Connected(v Vlan, veth netlink.Link) bool
+	// Trunk carries v tagged on a veth already connected to its own vlan,
+	// name is the vlan device it may create on the veth for that. It returns
+	// the devices it created like Connect.
+	Trunk(v Vlan, veth netlink.Link, name string) (created []string, err error)
+}
+
+func newDatapath(option DriverOption, dev string) (datapath, error) {
+	switch option.Datapath {
+	case "", DatapathBridge:
+		return &bridgeDatapath{vlanDevices{dev}}, nil
+	case DatapathVlanBridge:
+		return newVlanBridgeDatapath(option.VlanBridge, dev)
+	case DatapathOvs:
+		return newOvsDatapath(option.OvsBridge, dev)
+	}
+	return nil, fmt.Errorf("unknown datapath %q", option.Datapath)
+}
+
+// outerTags are the tags pushed in front of the vlan tag on the parent eth
+func (v Vlan) outerTags() []nl.VlanTag {
+	if v.Outer == 0 {
+		return nil
+	}
+	return []nl.VlanTag{{TPID: uint16(v.outerProtocol()), Id: v.Outer}}
+}
+
+func (v Vlan) outerProtocol() nl.VlanProtocol {
+	if v.OuterProtocol == Protocol8021Q {
+		return nl.VLAN_PROTOCOL_8021Q
+	}
+	return nl.VLAN_PROTOCOL_8021AD
+}
+
+// vlanDevices creates the <parent>.<vid> vlan device of a vlan, a QinQ vlan
+// device <parent>.s<outer>.<vid> is stacked on the <parent>.s<outer>
+// service tag device shared by the vlans of that service tag. The parent is
+// dev unless the vlan has its own.
+type vlanDevices struct {
+	dev string
+}
+
+func (vd vlanDevices) parent(v Vlan) string {
+	if v.Parent != "" {
+		return v.Parent
+	}
+	return vd.dev
+}
+
+func (vd vlanDevices) vlanName(v Vlan) string {
+	return fmt.Sprintf("%s.%s", vd.parent(v), v)
+}
+
+func (vd vlanDevices) outerName(v Vlan) string {
+	return fmt.Sprintf("%s.%s", vd.parent(v), v.outerString())
+}
+
+// createVlan creates the vlan device of v, and its outer device for QinQ,
+// it appends the devices it created to created
+func (vd vlanDevices) createVlan(v Vlan, created *[]string) (*netlink.Vlan, error) {
+	name := vd.vlanName(v)
+	if err := checkIfName(name); err != nil {
+		return nil, err
+	}
+
+	parent := vd.parent(v)
+	if v.Outer != 0 {
+		outerName := vd.outerName(v)
+		exists := linkExists(outerName)
+		outer, err := nl.CreateVlanWithProtocol(parent, v.Outer, v.outerProtocol(), outerName)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			*created = append(*created, outerName)
+		}
+		if err := nl.Set(outer, nl.UpSetter()); err != nil {
+			return nil, err
+		}
+		parent = outerName
+	}
+
+	exists := linkExists(name)
+	vlanDev, err := nl.CreateVlan(parent, v.Id, name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		*created = append(*created, name)
+	}
+	return vlanDev, nil
+}
+
+// destroyCreated destroys the created devices innermost first, the outer
+// device of a QinQ vlan only once no other vlan is stacked on it
+func (vd vlanDevices) destroyCreated(v Vlan, created []string) error {
+	for i := len(created) - 1; i >= 0; i-- {
+		var err error
+		if v.Outer != 0 && created[i] == vd.outerName(v) {
+			err = vd.releaseOuter(v)
+		} else {
+			err = nl.DestroyDevice(created[i])
+		}
+		if err != nil {
+			return err
+		}
+		logrus.WithField("device", created[i]).Info("roll back created device")
+	}
+	return nil
+}
+
+// releaseOuter destroys the outer device of a QinQ vlan unless a vlan device
+// is still stacked on it
+func (vd vlanDevices) releaseOuter(v Vlan) error {
+	if v.Outer == 0 {
+		return nil
+	}
+	outer, err := netlink.LinkByName(vd.outerName(v))
+	if err != nil {
+		return nil
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		if link.Attrs().ParentIndex == outer.Attrs().Index {
+			return nil
+		}
+	}
+	return destroyUnconfigured(vd.outerName(v))
+}
+
+// bridgeDatapath creates a <parent>.<vid> vlan device and a br0.<vid> linux
+// bridge for every vlan, br0.s<outer>.<vid> for a QinQ vlan and
+// br<hash>.<vid> for a vlan on its own parent
+type bridgeDatapath struct {
+	vlanDevices
+}
+
+func (dp *bridgeDatapath) bridgeName(v Vlan) string {
+	return fmt.Sprintf("%s.%s", bridgePrefix(v.Parent), v)
+}
+
+// bridgePrefix is br0 for the default parent eth and br<hash> with 4 hex
+// digits of the parent name otherwise, a parent name would not leave room
+// for the vlan within the device name limit. Connect refuses a bridge of a
+// colliding parent.
+func bridgePrefix(parent string) string {
+	if parent == "" {
+		return "br0"
+	}
+	h := fnv.New32a()
+	h.Write([]byte(parent))
+	sum := h.Sum32()
+	return fmt.Sprintf("br%04x", (sum>>16^sum)&0xffff)
+}
+
+// checkBridgeUplink fails if an existing bridge has a vlan device other than
+// uplink as port, the hashed names of two parents may collide and reusing the
+// bridge would bridge both uplinks together. Trunk vlan devices stacked on a
+// veth are not uplinks.
+func checkBridgeUplink(bridge, uplink string) error {
+	bridgeDev, err := netlink.LinkByName(bridge)
+	if err != nil {
+		return nil
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+
+	types := map[int]string{}
+	for _, link := range links {
+		types[link.Attrs().Index] = link.Type()
+	}
+	for _, link := range links {
+		attrs := link.Attrs()
+		if attrs.MasterIndex != bridgeDev.Attrs().Index || link.Type() != "vlan" || attrs.Name == uplink {
+			continue
+		}
+		if types[attrs.ParentIndex] != "veth" {
+			return fmt.Errorf("bridge %s already has uplink %s, not %s", bridge, attrs.Name, uplink)
+		}
+	}
+	return nil
+}
+
+func (dp *bridgeDatapath) Devices(v Vlan) []string {
+	if v.Outer != 0 {
+		return []string{dp.outerName(v), dp.vlanName(v), dp.bridgeName(v)}
+	}
+	return []string{dp.vlanName(v), dp.bridgeName(v)}
+}
+
+func (dp *bridgeDatapath) Connect(v Vlan, veth netlink.Link) (created []string, err error) {
+	defer func() {
+		if err != nil {
+			dp.destroyUnused(v, created)
+			created = nil
+		}
+	}()
+
+	if err = checkIfName(dp.bridgeName(v)); err != nil {
+		return created, err
+	}
+	if err = checkBridgeUplink(dp.bridgeName(v), dp.vlanName(v)); err != nil {
+		return created, err
+	}
+	vlanDev, err := dp.createVlan(v, &created)
+	if err != nil {
+		return created, err
+	}
+
+	bridgeExists := linkExists(dp.bridgeName(v))
+	bridgeDev, err := nl.CreateBridge(dp.bridgeName(v))
+	if err != nil {
+		return created, err
+	}
+	if !bridgeExists {
+		created = append(created, dp.bridgeName(v))
+	}
+
+	linkSetUp := nl.UpSetter()
+	for _, link := range []netlink.Link{bridgeDev, vlanDev} {
+		if err = linkSetUp(link); err != nil {
+			return created, err
+		}
+	}
+
+	linkSetMaster := nl.JoinNetworkSetter(bridgeDev)
+	if err = linkSetMaster(vlanDev); err != nil {
+		return created, err
+	}
+
+	return created, nl.Set(veth, nl.JoinNetworkSetter(bridgeDev), nl.UpSetter())
+}
+
+func (dp *bridgeDatapath) Connected(v Vlan, veth netlink.Link) bool {
+	bridgeDev, err := netlink.LinkByName(dp.bridgeName(v))
+	if err != nil {
+		return false
+	}
+	vlanDev, err := netlink.LinkByName(dp.vlanName(v))
+	if err != nil {
+		return false
+	}
+	index := bridgeDev.Attrs().Index
+	return veth.Attrs().MasterIndex == index && vlanDev.Attrs().MasterIndex == index
+}
+
+// Trunk stacks the name vlan device on the veth and connects it like a veth
+func (dp *bridgeDatapath) Trunk(v Vlan, veth netlink.Link, name string) ([]string, error) {
+	trunkDev, err := nl.CreateVlan(veth.Attrs().Name, v.Id, name)
+	if err != nil {
+		return nil, err
+	}
+	return dp.Connect(v, trunkDev)
+}
+
+func (dp *bridgeDatapath) Rollback(v Vlan, veth string, created []string) error {
+	if err := nl.DestroyDevice(veth); err != nil {
+		return err
+	}
+	return dp.destroyUnused(v, created)
+}
+
+// destroyUnused destroys the given devices of the vlan unless an endpoint is
+// connected to its bridge
+func (dp *bridgeDatapath) destroyUnused(v Vlan, devices []string) error {
+	if len(devices) == 0 {
+		return nil
+	}
+
+	if linkExists(dp.bridgeName(v)) {
+		devs, err := nl.GetDevicesAttachedOnBridge(dp.bridgeName(v))
+		if err != nil {
+			return err
+		}
+		for _, dev := range devs {
+			if dev != dp.vlanName(v) {
+				logrus.WithFields(logrus.Fields{"bridge": dp.bridgeName(v), "devices": devs}).Debug("bridge still in use, keep created devices")
+				return nil
+			}
+		}
+	}
+
+	return dp.destroyCreated(v, devices)
+}
+
+// destroyUnconfigured destroys a vlan device unless it carries an address,
+// a vlan device without bridge may be configured by the host
+func destroyUnconfigured(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !addr.IP.IsLinkLocalUnicast() {
+			return nil
+		}
+	}
+	return nl.DestroyDevice(name)
+}
+
+func linkExists(name string) bool {
+	_, err := netlink.LinkByName(name)
+	return err == nil
+}
+
+func (dp *bridgeDatapath) Disconnect(v Vlan, veth string) error {
+	if err := nl.DestroyDevice(veth); err != nil {
+		return err
+	}
+	if v == (Vlan{}) {
+		return nil
+	}
+	return dp.Release(v)
+}
+
+func (dp *bridgeDatapath) Release(v Vlan) error {
+	if _, err := netlink.LinkByName(dp.bridgeName(v)); err != nil {
+		if err := destroyUnconfigured(dp.vlanName(v)); err != nil {
+			return err
+		}
+		return dp.releaseOuter(v)
+	}
+
+	devs, err := nl.GetDevicesAttachedOnBridge(dp.bridgeName(v))
+	if err != nil {
+		return err
+	}
+	for _, dev := range devs {
+		if dev != dp.vlanName(v) {
+			logrus.WithFields(logrus.Fields{"bridge": dp.bridgeName(v), "devices": devs}).Debug("bridge still in use")
+			return nil
+		}
+	}
+
+	if err := nl.DestroyDevice(dp.vlanName(v)); err != nil {
+		return err
+	}
+	if err := nl.DestroyDevice(dp.bridgeName(v)); err != nil {
+		return err
+	}
+	if err := dp.releaseOuter(v); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"bridge": dp.bridgeName(v), "vlan": dp.vlanName(v)}).Info("successfully release vlan devices")
+	return nil
+}
+
+// vlanBridgeDatapath shares one vlan filtering bridge between all vlans, the
+// parent eth trunks every vlan in use and each veth is an untagged access port
+// with its vlan as pvid
+type vlanBridgeDatapath struct {
+	dev    netlink.Link
+	bridge *netlink.Bridge
+	// defaultPvid is the vlan ports join untagged, taken off the veths so
+	// the untagged host traffic stays out of the containers
+	defaultPvid int
+}
+
+// newVlanBridgeDatapath needs the parent eth to be a port of the bridge
+// already, enslaving it would cut the host off as its addresses and routes
+// stay on the parent eth
+func newVlanBridgeDatapath(bridgeName, dev string) (*vlanBridgeDatapath, error) {
+	parent, err := netlink.LinkByName(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := netlink.LinkByName(bridgeName)
+	bridge, ok := link.(*netlink.Bridge)
+	if err != nil || !ok || parent.Attrs().MasterIndex != bridge.Attrs().Index {
+		return nil, fmt.Errorf("parent eth %s is not a port of bridge %s, attach it and move its addresses and routes to the bridge first", dev, bridgeName)
+	}
+
+	defaultPvid, err := nl.EnableVlanFiltering(bridgeName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &vlanBridgeDatapath{dev: parent, bridge: bridge, defaultPvid: defaultPvid}, nil
+}
+
+func (dp *vlanBridgeDatapath) Devices(v Vlan) []string {
+	return []string{dp.bridge.Attrs().Name}
+}
+
+// Connect creates no device, the vlan stays trunked on the parent eth
+func (dp *vlanBridgeDatapath) Connect(v Vlan, veth netlink.Link) ([]string, error) {
+	if err := bridgeOnly(v); err != nil {
+		return nil, err
+	}
+	if err := nl.BridgeVlanAdd(dp.dev, v.Id, false); err != nil {
+		return nil, err
+	}
+
+	if err := nl.Set(veth, nl.JoinNetworkSetter(dp.bridge)); err != nil {
+		return nil, err
+	}
+	if err := nl.BridgeVlanAdd(veth, v.Id, true); err != nil {
+		return nil, err
+	}
+	if dp.defaultPvid != 0 && dp.defaultPvid != v.Id {
+		if err := nl.BridgeVlanDel(veth, dp.defaultPvid); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nl.Set(veth, nl.UpSetter())
+}
+
+func (dp *vlanBridgeDatapath) Connected(v Vlan, veth netlink.Link) bool {
+	return veth.Attrs().MasterIndex == dp.bridge.Attrs().Index
+}
+
+// Trunk adds the vlan tagged to the veth port, a port leaves its vlans with
+// the veth
+func (dp *vlanBridgeDatapath) Trunk(v Vlan, veth netlink.Link, name string) ([]string, error) {
+	if err := bridgeOnly(v); err != nil {
+		return nil, err
+	}
+	if err := nl.BridgeVlanAdd(dp.dev, v.Id, false); err != nil {
+		return nil, err
+	}
+	return nil, nl.BridgeVlanAdd(veth, v.Id, false)
+}
+
+func (dp *vlanBridgeDatapath) Disconnect(v Vlan, veth string) error {
+	return nl.DestroyDevice(veth)
+}
+
+func (dp *vlanBridgeDatapath) Rollback(v Vlan, veth string, created []string) error {
+	return dp.Disconnect(v, veth)
+}
+
+// Release keeps the vlan trunked on the parent eth, the shared bridge is never torn down
+func (dp *vlanBridgeDatapath) Release(v Vlan) error {
+	return nil
+}
+
+// ovsDatapath plugs every veth as an access port with tag=<vid> into one
+// openvswitch bridge, the parent eth is a trunk port of that bridge
+type ovsDatapath struct {
+	bridge string
+}
+
+// newOvsDatapath needs the parent eth to be a port of the bridge already,
+// adding it would cut the host off as its addresses and routes stay on the
+// parent eth
+func newOvsDatapath(bridge, dev string) (*ovsDatapath, error) {
+	if attached, err := ovs.PortBridge(dev); err != nil || attached != bridge {
+		return nil, fmt.Errorf("parent eth %s is not a port of ovs bridge %s, attach it and move its addresses and routes to the bridge first", dev, bridge)
+	}
+
+	return &ovsDatapath{bridge: bridge}, nil
+}
+
+func (dp *ovsDatapath) Devices(v Vlan) []string {
+	return []string{dp.bridge}
+}
+
+// Connect creates no device, the access port only lives with the veth
+func (dp *ovsDatapath) Connect(v Vlan, veth netlink.Link) ([]string, error) {
+	if err := bridgeOnly(v); err != nil {
+		return nil, err
+	}
+	if err := nl.Set(veth, nl.UpSetter()); err != nil {
+		return nil, err
+	}
+
+	name := veth.Attrs().Name
+	if ovs.ExistsPort(name) == nil {
+		if err := ovs.DelPort(dp.bridge, name); err != nil {
+			return nil, err
+		}
+	}
+	_, err := ovs.AddPort(dp.bridge, name, fmt.Sprintf("tag=%d", v.Id))
+	return nil, err
+}
+
+// Connected checks the bridge and tag of the access port, re-adding a port
+// would drop its traffic and change its ofport
+func (dp *ovsDatapath) Connected(v Vlan, veth netlink.Link) bool {
+	name := veth.Attrs().Name
+	if bridge, err := ovs.PortBridge(name); err != nil || bridge != dp.bridge {
+		return false
+	}
+	tag, err := ovs.PortTag(name)
+	return err == nil && tag == v.Id
+}
+
+// Trunk adds the vlan to the trunks of the access port, which keeps its own
+// vlan untagged
+func (dp *ovsDatapath) Trunk(v Vlan, veth netlink.Link, name string) ([]string, error) {
+	if err := bridgeOnly(v); err != nil {
+		return nil, err
+	}
+	return nil, ovs.AddPortTrunk(veth.Attrs().Name, v.Id)
+}
+
+func (dp *ovsDatapath) Disconnect(v Vlan, veth string) error {
+	if ovs.ExistsPort(veth) == nil {
+		if err := ovs.DelPort(dp.bridge, veth); err != nil {
+			return err
+		}
+	}
+	return nl.DestroyDevice(veth)
+}
+
+func (dp *ovsDatapath) Rollback(v Vlan, veth string, created []string) error {
+	return dp.Disconnect(v, veth)
+}
+
+// Release does nothing, access ports leave the bridge with their veth
+func (dp *ovsDatapath) Release(v Vlan) error {
+	return nil
+}
@@ -0,0 +1,219 @@
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/libkv/store"
+)
+
+// HeartbeatOption controls the heartbeat of this host and the purge of the
+// endpoints left behind by dead hosts
+type HeartbeatOption struct {
+	// Interval is how often the heartbeat key is refreshed, it expires after TTL
+	Interval time.Duration
+	TTL      time.Duration
+	// Purge elects one instance to delete the endpoint and tunnel records of
+	// hosts whose heartbeat is missing for longer than Grace, DryRun only
+	// reports them
+	Purge         bool
+	Grace         time.Duration
+	PurgeInterval time.Duration
+	DryRun        bool
+}
+
+// heartbeat is the value of the host/<hostname> key
+type heartbeat struct {
+	Hostname  string    `json:"hostname"`
+	ParentEth string    `json:"parentEth"`
+	Updated   time.Time `json:"updated"`
+}
+
+// StartHeartbeat registers this host with a ttl'd key in s and, if enabled,
+// runs for the leadership of the dead host purge
+func (d *Driver) StartHeartbeat(s store.Store, option HeartbeatOption) error {
+	if option.Interval <= 0 {
+		return errors.New("heartbeat interval must be positive")
+	}
+	if option.TTL <= option.Interval {
+		return errors.New("heartbeat ttl must be longer than the heartbeat interval")
+	}
+	if option.Purge && option.Grace <= 0 {
+		return errors.New("purging dead hosts needs a grace period")
+	}
+	if option.Purge && option.PurgeInterval <= 0 {
+		return errors.New("purge interval must be positive")
+	}
+	go d.heartbeat(s, option)
+	if option.Purge {
+		go d.purgeLeader(s, option)
+	}
+	return nil
+}
+
+func (d *Driver) heartbeat(s store.Store, option HeartbeatOption) {
+	for {
+		data, err := json.Marshal(&heartbeat{Hostname: d.hostname, ParentEth: d.dev, Updated: time.Now()})
+		if err == nil {
+			err = s.Put(normalize("host", d.hostname), data, &store.WriteOptions{TTL: option.TTL})
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"host": d.hostname, "err": err}).Warn("cannot refresh heartbeat")
+		}
+		time.Sleep(option.Interval)
+	}
+}
+
+// purgeLeader waits for the purge lock and purges dead hosts as long as it
+// holds it
+func (d *Driver) purgeLeader(s store.Store, option HeartbeatOption) {
+	for {
+		lock, err := s.NewLock(normalize("purge-leader"), &store.LockOptions{Value: []byte(d.hostname), TTL: option.TTL})
+		if err != nil {
+			logrus.WithField("err", err).Warn("cannot create purge lock, retry later")
+			time.Sleep(option.PurgeInterval)
+			continue
+		}
+
+		lost, err := lock.Lock(nil)
+		if err != nil {
+			logrus.WithField("err", err).Warn("cannot acquire purge lock, retry later")
+			time.Sleep(option.PurgeInterval)
+			continue
+		}
+		logrus.WithField("host", d.hostname).Info("elected as dead host purge leader")
+
+		missing := map[string]time.Time{}
+		ticker := time.NewTicker(option.PurgeInterval)
+	lead:
+		for {
+			select {
+			case <-lost:
+				logrus.WithField("host", d.hostname).Warn("lost dead host purge leadership")
+				break lead
+			case <-ticker.C:
+				if err := d.purge(s, option, missing); err != nil {
+					logrus.WithField("err", err).Warn("purge dead hosts error")
+				}
+			}
+		}
+		ticker.Stop()
+	}
+}
+
+// purge deletes the endpoint and tunnel records of hosts whose heartbeat is
+// missing for longer than the grace period. missing tracks since when each
+// host misses.
+func (d *Driver) purge(s store.Store, option HeartbeatOption, missing map[string]time.Time) error {
+	alive := map[string]bool{d.hostname: true}
+	kvs, err := s.List(normalize("host"))
+	if err != nil && err != store.ErrKeyNotFound {
+		return err
+	}
+	for _, kv := range kvs {
+		var hb heartbeat
+		if err := json.Unmarshal(kv.Value, &hb); err != nil || hb.Hostname == "" {
+			alive[path.Base(kv.Key)] = true
+			continue
+		}
+		alive[hb.Hostname] = true
+	}
+
+	endpoints, err := d.endpoints.List()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	owners := map[string]bool{}
+	// dead tells whether ep still belongs to a host missing for longer than
+	// the grace period, a host which just joined may not have written its
+	// heartbeat yet
+	dead := func(ep *Endpoint) bool {
+		if ep.Host == nil || ep.Host.Hostname == "" || alive[ep.Host.Hostname] {
+			return false
+		}
+		return now.Sub(missing[ep.Host.Hostname]) >= option.Grace && now.Sub(ep.Host.JoinedAt) >= option.Grace
+	}
+	for _, ep := range endpoints {
+		if ep.Host == nil || ep.Host.Hostname == "" || alive[ep.Host.Hostname] {
+			continue
+		}
+		host := ep.Host.Hostname
+		owners[host] = true
+		if _, ok := missing[host]; !ok {
+			missing[host] = now
+		}
+		if !dead(ep) {
+			continue
+		}
+
+		fields := logrus.Fields{"endpoint": ep.EndpointID, "network": ep.NetworkID, "host": host}
+		if option.DryRun {
+			logrus.WithFields(fields).Info("would purge endpoint of dead host")
+			continue
+		}
+		purged, err := purgeEndpoint(s, ep.EndpointID, dead)
+		if err != nil {
+			logrus.WithFields(fields).WithField("err", err).Warn("cannot purge endpoint of dead host")
+			continue
+		}
+		if !purged {
+			continue
+		}
+		if err := (Tunnels{s}).Delete(ep.EndpointID); err != nil {
+			logrus.WithFields(fields).WithField("err", err).Warn("cannot purge tunnel of dead host")
+		}
+		logrus.WithFields(fields).Info("purge endpoint of dead host")
+	}
+
+	// forget hosts which came back or have no endpoint left
+	for host := range missing {
+		if !owners[host] {
+			delete(missing, host)
+		}
+	}
+	return nil
+}
+
+// purgeEndpoint deletes the record of endpoint id as long as dead still holds
+// for it and its host has no heartbeat. The record is read again and deleted
+// against its index, so a join or leave of a host coming back meanwhile keeps
+// it.
+func purgeEndpoint(s store.Store, id string, dead func(*Endpoint) bool) (bool, error) {
+	key := normalize("endpoint", id)
+	for {
+		kv, err := s.Get(key)
+		if err != nil {
+			if err == store.ErrKeyNotFound {
+				return false, nil
+			}
+			return false, err
+		}
+		ep, _, err := decodeEndpoint(kv.Value)
+		if err != nil {
+			return false, err
+		}
+		if !dead(ep) {
+			return false, nil
+		}
+		// the host may have come back since the heartbeats were listed
+		if back, err := s.Exists(normalize("host", ep.Host.Hostname)); err != nil || back {
+			return false, err
+		}
+
+		_, err = s.AtomicDelete(key, kv)
+		switch err {
+		case nil:
+			return true, nil
+		case store.ErrKeyNotFound:
+			return false, nil
+		case store.ErrKeyModified:
+			continue
+		}
+		return false, err
+	}
+}
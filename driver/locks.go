@@ -0,0 +1,41 @@
+package driver
+
+import "sync"
+
+// keyedMutex hands out one mutex per key, so that work on different keys
+// proceeds in parallel. Entries are dropped once nobody holds or waits on them.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[interface{}]*refMutex
+}
+
+type refMutex struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock locks key and returns the function unlocking it
+func (km *keyedMutex) Lock(key interface{}) func() {
+	km.mu.Lock()
+	if km.locks == nil {
+		km.locks = map[interface{}]*refMutex{}
+	}
+	l, ok := km.locks[key]
+	if !ok {
+		l = &refMutex{}
+		km.locks[key] = l
+	}
+	l.refs++
+	km.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		km.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(km.locks, key)
+		}
+		km.mu.Unlock()
+	}
+}
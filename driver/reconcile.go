@@ -0,0 +1,245 @@
+package driver
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/omega/vlan-netplugin/nl"
+	"github.com/vishvananda/netlink"
+)
+
+var vethNamePattern = regexp.MustCompile(`^v[0-9a-f]{12}$`)
+
+// Reconcile compares the devices on the host with the networks and endpoints
+// in the store, and removes or repairs what a crashed plugin or host left
+// behind. Only the devices of the stored networks and endpoints are touched,
+// vlan devices and veths of the same name pattern may belong to others.
+func (d *Driver) Reconcile() error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	endpoints, err := d.endpoints.List()
+	if err != nil {
+		return err
+	}
+	networks, err := d.networks.List()
+	if err != nil {
+		return err
+	}
+
+	var (
+		removed  []string
+		repaired []string
+		vlans    = map[Vlan]bool{}
+	)
+
+	names := map[string]bool{}
+	for _, link := range links {
+		names[link.Attrs().Name] = true
+	}
+
+	// the slaves handed to containers are not visible from the host, count
+	// the endpoints joined on this host before any vlan device is released
+	modes := map[Vlan]string{}
+	parents := map[string]bool{}
+	for _, n := range networks {
+		v, err := d.hostVlan(n)
+		if err != nil {
+			continue
+		}
+		modes[v] = ModeVeth
+		if v.Parent != "" {
+			parents[v.Parent] = true
+		}
+		if modes[v], err = n.Mode(); err != nil || modes[v] == ModeVeth || d.slaves == nil {
+			continue
+		}
+		for _, ep := range endpoints {
+			if ep.NetworkID == n.NetworkID && ep.Host != nil && ep.Host.Hostname == d.hostname && ep.Host.LeftAt.IsZero() {
+				d.slaves.track(v, ep.EndpointID)
+			}
+		}
+	}
+
+	// the devices the endpoints of this host were attached to, e.g. the
+	// bridges of trunked vlans
+	recorded := map[string]bool{}
+	for _, ep := range endpoints {
+		if ep.Host != nil && ep.Host.Hostname == d.hostname {
+			for _, dev := range ep.Host.Devices {
+				recorded[dev] = true
+			}
+		}
+	}
+
+	for _, link := range links {
+		name := link.Attrs().Name
+
+		if v, ok := d.vlanFromName(name, parents); ok {
+			if _, known := modes[v]; known || recorded[name] {
+				vlans[v] = true
+			} else {
+				logrus.WithField("device", name).Debug("leave device of no stored network")
+			}
+			continue
+		}
+
+		if slaveNamePattern.MatchString(name) {
+			if findEndpoint(endpoints, func(e *Endpoint) bool { return e.SlaveName() == name }) == nil {
+				logrus.WithField("slave", name).Warn("leave slave of unknown endpoint")
+				continue
+			}
+			// a slave left in the host namespace never reached its container
+			logrus.WithField("slave", name).Info("remove slave of unfinished join")
+			if err := nl.DestroyDevice(name); err != nil {
+				logrus.WithFields(logrus.Fields{"slave": name, "err": err}).Warn("cannot remove slave")
+				continue
+			}
+			removed = append(removed, name)
+			continue
+		}
+
+		if _, ok := link.(*netlink.Veth); !ok || !vethNamePattern.MatchString(name) {
+			continue
+		}
+
+		ep := findEndpoint(endpoints, func(e *Endpoint) bool { return e.VethName() == name })
+		if ep == nil {
+			logrus.WithField("veth", name).Warn("leave veth of unknown endpoint")
+			continue
+		}
+
+		n, err := d.networks.Get(ep.NetworkID)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"veth": name, "network": ep.NetworkID, "err": err}).Warn("cannot get network of endpoint")
+			continue
+		}
+		v, err := d.hostVlan(n)
+		if err != nil {
+			// not a vlan network, e.g. owned by the vxlan driver
+			continue
+		}
+
+		// the container side still lives in the host namespace, the join never completed
+		if names["v"+name] {
+			logrus.WithFields(logrus.Fields{"veth": name, "endpoint": ep.EndpointID}).Info("remove veth of unfinished join")
+			if err := d.disconnect(v, name); err != nil {
+				logrus.WithFields(logrus.Fields{"veth": name, "err": err}).Warn("cannot remove veth")
+				continue
+			}
+			removed = append(removed, name)
+			continue
+		}
+
+		unlockVlan := d.lockVlan(v)
+		if d.datapath.Connected(v, link) {
+			logrus.WithFields(logrus.Fields{"veth": name, "endpoint": ep.EndpointID, "vlan": v}).Debug("veth of joined endpoint still connected")
+		} else {
+			logrus.WithFields(logrus.Fields{"veth": name, "endpoint": ep.EndpointID, "vlan": v}).Info("reconnect veth of joined endpoint")
+			_, err = d.datapath.Connect(v, link)
+		}
+		unlockVlan()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"veth": name, "err": err}).Warn("cannot reconnect veth")
+			continue
+		}
+		vlans[v] = true
+		trunks, _ := d.hostTrunks(n, ep, v)
+		for _, t := range trunks {
+			unlockVlan := d.lockVlan(t)
+			_, err := d.datapath.Trunk(t, link, ep.TrunkName(t.Id))
+			unlockVlan()
+			if err != nil {
+				logrus.WithFields(logrus.Fields{"veth": name, "vlan": t, "err": err}).Warn("cannot trunk vlan on veth")
+			}
+			vlans[t] = true
+		}
+		repaired = append(repaired, name)
+	}
+
+	var released []string
+	for v := range vlans {
+		mode := modes[v]
+		if mode == "" {
+			mode = ModeVeth
+		}
+		if err := d.release(v, mode); err != nil {
+			logrus.WithFields(logrus.Fields{"vlan": v, "err": err}).Warn("cannot release vlan devices")
+			continue
+		}
+		released = append(released, v.String())
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"removed":  removed,
+		"repaired": repaired,
+		"released": released,
+	}).Info("successfully reconcile host devices")
+	return nil
+}
+
+func findEndpoint(endpoints []*Endpoint, match func(*Endpoint) bool) *Endpoint {
+	for _, e := range endpoints {
+		if match(e) {
+			return e
+		}
+	}
+	return nil
+}
+
+func (d *Driver) disconnect(v Vlan, veth string) error {
+	defer d.lockVlan(v)()
+	return d.datapath.Disconnect(v, veth)
+}
+
+// vlanFromName parses the vlan of a br0.<vlan> bridge or a <parent>.<vlan>
+// vlan device, where vlan is <vid>, s<outer>.<vid> or q<outer>.<vid>, and
+// of a br<hash>.<vlan> bridge of one of the given parents
+func (d *Driver) vlanFromName(name string, parents map[string]bool) (Vlan, bool) {
+	prefixes := map[string]string{"br0.": "", d.dev + ".": ""}
+	for parent := range parents {
+		prefixes[bridgePrefix(parent)+"."] = parent
+		prefixes[parent+"."] = parent
+	}
+
+	for prefix, parent := range prefixes {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		// prefixes may overlap, try the others if the rest does not parse
+		if v, ok := parseVlan(strings.TrimPrefix(name, prefix)); ok {
+			v.Parent = parent
+			return v, true
+		}
+	}
+	return Vlan{}, false
+}
+
+// parseVlan parses the vlan part of a device name, the inverse of Vlan.String
+func parseVlan(s string) (Vlan, bool) {
+	var v Vlan
+	if i := strings.Index(s, "."); i > 0 {
+		switch s[0] {
+		case 's':
+			v.OuterProtocol = Protocol8021AD
+		case 'q':
+			v.OuterProtocol = Protocol8021Q
+		default:
+			return Vlan{}, false
+		}
+		outer, err := strconv.Atoi(s[1:i])
+		if err != nil || outer <= 0 || outer >= 4096 {
+			return Vlan{}, false
+		}
+		v.Outer, s = outer, s[i+1:]
+	}
+	vlanId, err := strconv.Atoi(s)
+	if err != nil || vlanId <= 0 || vlanId >= 4096 {
+		return Vlan{}, false
+	}
+	v.Id = vlanId
+	return v, true
+}
@@ -0,0 +1,340 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libkv/store"
+)
+
+// schemaVersion is the version of the records written to the store. Records
+// of an older version are upgraded on read by the migrations, records of a
+// newer version are refused.
+const schemaVersion = 1
+
+// migration upgrades a raw record from version i to i+1, where i is its index
+// in the migrations of the record kind
+type migration func(record map[string]interface{}) error
+
+var (
+	networkMigrations = []migration{
+		// v0 is the docker CreateNetworkRequest stored verbatim
+		func(r map[string]interface{}) error {
+			rename(r, "NetworkID", "networkId")
+			rename(r, "Options", "options")
+			for _, family := range []string{"IPv4Data", "IPv6Data"} {
+				pools, _ := r[family].([]interface{})
+				for _, pool := range pools {
+					if p, ok := pool.(map[string]interface{}); ok {
+						rename(p, "AddressSpace", "addressSpace")
+						rename(p, "Pool", "pool")
+						rename(p, "Gateway", "gateway")
+						rename(p, "AuxAddresses", "auxAddresses")
+					}
+				}
+			}
+			return nil
+		},
+	}
+
+	endpointMigrations = []migration{
+		// v0 is the docker CreateEndpointRequest stored verbatim
+		func(r map[string]interface{}) error {
+			rename(r, "NetworkID", "networkId")
+			rename(r, "EndpointID", "endpointId")
+			rename(r, "Options", "options")
+			rename(r, "GatewayReachable", "gatewayReachable")
+			rename(r, "GatewayMac", "gatewayMac")
+			if i, ok := r["Interface"].(map[string]interface{}); ok {
+				rename(i, "Address", "address")
+				rename(i, "AddressIPv6", "addressIPv6")
+				rename(i, "MacAddress", "macAddress")
+			}
+			rename(r, "Interface", "interface")
+			return nil
+		},
+	}
+)
+
+func rename(r map[string]interface{}, from, to string) {
+	if v, ok := r[from]; ok {
+		delete(r, from)
+		r[to] = v
+	}
+}
+
+type networkRecord struct {
+	SchemaVersion int                    `json:"schemaVersion"`
+	NetworkID     string                 `json:"networkId"`
+	Options       map[string]interface{} `json:"options,omitempty"`
+	// the subnets keep their v0 keys, plugins predating the schema version
+	// would not find them otherwise
+	IPv4 []*ipamRecord `json:"IPv4Data,omitempty"`
+	IPv6 []*ipamRecord `json:"IPv6Data,omitempty"`
+}
+
+type ipamRecord struct {
+	AddressSpace string                 `json:"addressSpace,omitempty"`
+	Pool         string                 `json:"pool"`
+	Gateway      string                 `json:"gateway,omitempty"`
+	AuxAddresses map[string]interface{} `json:"auxAddresses,omitempty"`
+}
+
+type endpointRecord struct {
+	SchemaVersion    int                    `json:"schemaVersion"`
+	NetworkID        string                 `json:"networkId"`
+	EndpointID       string                 `json:"endpointId"`
+	Interface        *interfaceRecord       `json:"interface,omitempty"`
+	Options          map[string]interface{} `json:"options,omitempty"`
+	GatewayReachable *bool                  `json:"gatewayReachable,omitempty"`
+	GatewayMac       string                 `json:"gatewayMac,omitempty"`
+	Host             *hostRecord            `json:"host,omitempty"`
+}
+
+type hostRecord struct {
+	Hostname  string     `json:"hostname"`
+	ParentEth string     `json:"parentEth,omitempty"`
+	Veth      string     `json:"veth,omitempty"`
+	PeerVeth  string     `json:"peerVeth,omitempty"`
+	Devices   []string   `json:"devices,omitempty"`
+	JoinedAt  time.Time  `json:"joinedAt"`
+	LeftAt    *time.Time `json:"leftAt,omitempty"`
+}
+
+type interfaceRecord struct {
+	Address     string `json:"address,omitempty"`
+	AddressIPv6 string `json:"addressIPv6,omitempty"`
+	MacAddress  string `json:"macAddress,omitempty"`
+}
+
+func newNetworkRecord(n *Network) *networkRecord {
+	return &networkRecord{
+		SchemaVersion: schemaVersion,
+		NetworkID:     n.NetworkID,
+		Options:       n.Options,
+		IPv4:          newIPAMRecords(n.IPv4Data),
+		IPv6:          newIPAMRecords(n.IPv6Data),
+	}
+}
+
+func (r *networkRecord) network() *Network {
+	return &Network{&network.CreateNetworkRequest{
+		NetworkID: r.NetworkID,
+		Options:   r.Options,
+		IPv4Data:  ipamData(r.IPv4),
+		IPv6Data:  ipamData(r.IPv6),
+	}}
+}
+
+func newIPAMRecords(pools []*network.IPAMData) []*ipamRecord {
+	var records []*ipamRecord
+	for _, p := range pools {
+		records = append(records, &ipamRecord{
+			AddressSpace: p.AddressSpace,
+			Pool:         p.Pool,
+			Gateway:      p.Gateway,
+			AuxAddresses: p.AuxAddresses,
+		})
+	}
+	return records
+}
+
+func ipamData(records []*ipamRecord) []*network.IPAMData {
+	var pools []*network.IPAMData
+	for _, r := range records {
+		pools = append(pools, &network.IPAMData{
+			AddressSpace: r.AddressSpace,
+			Pool:         r.Pool,
+			Gateway:      r.Gateway,
+			AuxAddresses: r.AuxAddresses,
+		})
+	}
+	return pools
+}
+
+func newEndpointRecord(e *Endpoint) *endpointRecord {
+	r := &endpointRecord{
+		SchemaVersion:    schemaVersion,
+		NetworkID:        e.NetworkID,
+		EndpointID:       e.EndpointID,
+		Options:          e.Options,
+		GatewayReachable: e.GatewayReachable,
+		GatewayMac:       e.GatewayMac,
+	}
+	if e.Interface != nil {
+		r.Interface = &interfaceRecord{
+			Address:     e.Interface.Address,
+			AddressIPv6: e.Interface.AddressIPv6,
+			MacAddress:  e.Interface.MacAddress,
+		}
+	}
+	if e.Host != nil {
+		r.Host = &hostRecord{
+			Hostname:  e.Host.Hostname,
+			ParentEth: e.Host.ParentEth,
+			Veth:      e.Host.Veth,
+			PeerVeth:  e.Host.PeerVeth,
+			Devices:   e.Host.Devices,
+			JoinedAt:  e.Host.JoinedAt,
+		}
+		if !e.Host.LeftAt.IsZero() {
+			r.Host.LeftAt = &e.Host.LeftAt
+		}
+	}
+	return r
+}
+
+func (r *endpointRecord) endpoint() *Endpoint {
+	e := &Endpoint{
+		CreateEndpointRequest: &network.CreateEndpointRequest{
+			NetworkID:  r.NetworkID,
+			EndpointID: r.EndpointID,
+			Options:    r.Options,
+		},
+		GatewayReachable: r.GatewayReachable,
+		GatewayMac:       r.GatewayMac,
+	}
+	if r.Interface != nil {
+		e.Interface = &network.EndpointInterface{
+			Address:     r.Interface.Address,
+			AddressIPv6: r.Interface.AddressIPv6,
+			MacAddress:  r.Interface.MacAddress,
+		}
+	}
+	if r.Host != nil {
+		e.Host = &EndpointHost{
+			Hostname:  r.Host.Hostname,
+			ParentEth: r.Host.ParentEth,
+			Veth:      r.Host.Veth,
+			PeerVeth:  r.Host.PeerVeth,
+			Devices:   r.Host.Devices,
+			JoinedAt:  r.Host.JoinedAt,
+		}
+		if r.Host.LeftAt != nil {
+			e.Host.LeftAt = *r.Host.LeftAt
+		}
+	}
+	return e
+}
+
+// decodeRecord unmarshals data into v after upgrading it to the current
+// schema version, it returns the version data was written with
+func decodeRecord(data []byte, migrations []migration, v interface{}) (int, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return 0, err
+	}
+
+	version := 0
+	if n, ok := raw["schemaVersion"].(float64); ok {
+		version = int(n)
+	}
+	if version > schemaVersion {
+		return version, fmt.Errorf("record schema version %d is newer than %d, upgrade the plugin", version, schemaVersion)
+	}
+
+	if version < schemaVersion {
+		for _, m := range migrations[version:] {
+			if err := m(raw); err != nil {
+				return version, err
+			}
+		}
+		raw["schemaVersion"] = schemaVersion
+
+		var err error
+		if data, err = json.Marshal(raw); err != nil {
+			return version, err
+		}
+	}
+	return version, json.Unmarshal(data, v)
+}
+
+func decodeNetwork(data []byte) (*Network, int, error) {
+	var r *networkRecord
+	version, err := decodeRecord(data, networkMigrations, &r)
+	if err != nil {
+		return nil, version, err
+	}
+	return r.network(), version, nil
+}
+
+func decodeEndpoint(data []byte) (*Endpoint, int, error) {
+	var r *endpointRecord
+	version, err := decodeRecord(data, endpointMigrations, &r)
+	if err != nil {
+		return nil, version, err
+	}
+	return r.endpoint(), version, nil
+}
+
+// Migrate rewrites every network and endpoint record under prefix with the
+// current schema version, dryRun only reports the records to upgrade
+func Migrate(s store.Store, prefix string, dryRun bool) error {
+	setDefaultRootChains(prefix)
+
+	var migrated, current int
+	for _, kind := range []string{"network", "endpoint"} {
+		kvs, err := s.List(normalize(kind))
+		if err != nil {
+			if err == store.ErrKeyNotFound {
+				continue
+			}
+			return err
+		}
+
+		for _, kv := range kvs {
+			if directoryEntry(kv) {
+				continue
+			}
+			var (
+				id      string
+				version int
+				data    []byte
+			)
+			switch kind {
+			case "network":
+				n, v, err := decodeNetwork(kv.Value)
+				if err != nil {
+					return fmt.Errorf("decode %s %s: %v", kind, kv.Key, err)
+				}
+				id, version = n.NetworkID, v
+				data, err = json.Marshal(newNetworkRecord(n))
+				if err != nil {
+					return err
+				}
+			case "endpoint":
+				e, v, err := decodeEndpoint(kv.Value)
+				if err != nil {
+					return fmt.Errorf("decode %s %s: %v", kind, kv.Key, err)
+				}
+				id, version = e.EndpointID, v
+				data, err = json.Marshal(newEndpointRecord(e))
+				if err != nil {
+					return err
+				}
+			}
+
+			if version == schemaVersion {
+				current++
+				continue
+			}
+
+			fields := logrus.Fields{kind: id, "from": version, "to": schemaVersion}
+			if dryRun {
+				logrus.WithFields(fields).Info("would migrate record")
+			} else {
+				if err := s.Put(normalize(kind, id), data, nil); err != nil {
+					return err
+				}
+				logrus.WithFields(fields).Info("migrate record")
+			}
+			migrated++
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{"migrated": migrated, "current": current, "dryrun": dryRun}).Info("successfully migrate records")
+	return nil
+}
@@ -0,0 +1,242 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/libkv/store"
+	"github.com/omega/vlan-netplugin/nl"
+	"github.com/vishvananda/netlink"
+)
+
+var slaveNamePattern = regexp.MustCompile(`^vs[0-9a-f]{12}$`)
+
+// slaveDatapath hands each container a slave of the vlan device of its vlan
+// instead of a veth, no bridge is involved. Once moved into a
+// container the slaves are invisible from the host, so the endpoints using
+// a vlan device are tracked to know when to release it. Destroying the vlan
+// device would destroy their slaves as well.
+type slaveDatapath struct {
+	vlanDevices
+
+	sync.Mutex
+	endpoints map[Vlan]map[string]bool
+
+	// joined reports whether the store records an endpoint of this host
+	// other than endpointID joined on the vlan, the tracked endpoints are
+	// lost on restart
+	joined func(v Vlan, endpointID string) (bool, error)
+}
+
+func newSlaveDatapath(dev string) *slaveDatapath {
+	return &slaveDatapath{vlanDevices: vlanDevices{dev}, endpoints: map[Vlan]map[string]bool{}}
+}
+
+func (dp *slaveDatapath) Devices(v Vlan) []string {
+	if v.Outer != 0 {
+		return []string{dp.outerName(v), dp.vlanName(v)}
+	}
+	return []string{dp.vlanName(v)}
+}
+
+// Connect creates the slave named name of the given mode for endpointID, it
+// returns the devices it created, a failed Connect already removed them
+func (dp *slaveDatapath) Connect(v Vlan, mode, endpointID, name string, mac net.HardwareAddr) (created []string, err error) {
+	defer func() {
+		if err != nil {
+			dp.Rollback(v, endpointID, name, created)
+			created = nil
+		}
+	}()
+
+	vlanDev, err := dp.createVlan(v, &created)
+	if err != nil {
+		return created, err
+	}
+	if err = nl.Set(vlanDev, nl.UpSetter()); err != nil {
+		return created, err
+	}
+	dp.track(v, endpointID)
+
+	switch mode {
+	case ModeMacvlan:
+		_, err = nl.CreateMacvlan(vlanDev, name, mac)
+	case ModeIpvlanL2:
+		_, err = nl.CreateIpvlan(vlanDev, name, netlink.IPVLAN_MODE_L2)
+	case ModeIpvlanL3:
+		_, err = nl.CreateIpvlan(vlanDev, name, netlink.IPVLAN_MODE_L3)
+	default:
+		err = errModeIsInvalid
+	}
+	return created, err
+}
+
+// Disconnect removes the slave if it is back in the host namespace, and the
+// vlan device with the last endpoint using it
+func (dp *slaveDatapath) Disconnect(v Vlan, endpointID, name string) error {
+	if err := nl.DestroyDevice(name); err != nil {
+		return err
+	}
+	dp.untrack(v, endpointID)
+	return dp.release(v, endpointID)
+}
+
+// Rollback undoes a Connect of a failed join, the created vlan device is
+// kept if another endpoint got connected to it meanwhile
+func (dp *slaveDatapath) Rollback(v Vlan, endpointID, name string, created []string) error {
+	if err := nl.DestroyDevice(name); err != nil {
+		return err
+	}
+	dp.untrack(v, endpointID)
+	if dp.used(v) {
+		return nil
+	}
+	return dp.destroyCreated(v, created)
+}
+
+// Release destroys the vlan device unless an endpoint of this host uses it
+// or it is configured by the host
+func (dp *slaveDatapath) Release(v Vlan) error {
+	return dp.release(v, "")
+}
+
+// release destroys the vlan device unless an endpoint other than the leaving
+// endpointID is tracked or recorded in the store on it
+func (dp *slaveDatapath) release(v Vlan, endpointID string) error {
+	if dp.used(v) {
+		logrus.WithField("vlan", dp.vlanName(v)).Debug("vlan device still in use")
+		return nil
+	}
+	if dp.joined != nil {
+		if joined, err := dp.joined(v, endpointID); err != nil || joined {
+			logrus.WithFields(logrus.Fields{"vlan": dp.vlanName(v), "err": err}).Debug("vlan device still in use by a stored endpoint")
+			return err
+		}
+	}
+	if err := destroyUnconfigured(dp.vlanName(v)); err != nil {
+		return err
+	}
+	return dp.releaseOuter(v)
+}
+
+func (dp *slaveDatapath) track(v Vlan, endpointID string) {
+	dp.Lock()
+	defer dp.Unlock()
+	if dp.endpoints[v] == nil {
+		dp.endpoints[v] = map[string]bool{}
+	}
+	dp.endpoints[v][endpointID] = true
+}
+
+func (dp *slaveDatapath) untrack(v Vlan, endpointID string) {
+	dp.Lock()
+	defer dp.Unlock()
+	delete(dp.endpoints[v], endpointID)
+	if len(dp.endpoints[v]) == 0 {
+		delete(dp.endpoints, v)
+	}
+}
+
+func (dp *slaveDatapath) used(v Vlan) bool {
+	dp.Lock()
+	defer dp.Unlock()
+	return len(dp.endpoints[v]) > 0
+}
+
+// slaveJoined reports whether the store records an endpoint of this host
+// other than endpointID joined to a slave mode network on v
+func (d *Driver) slaveJoined(v Vlan, endpointID string) (bool, error) {
+	endpoints, err := d.endpoints.List()
+	if err != nil {
+		return false, err
+	}
+
+	networks := map[string]*Network{}
+	for _, ep := range endpoints {
+		if ep.EndpointID == endpointID || ep.Host == nil || ep.Host.Hostname != d.hostname || !ep.Host.LeftAt.IsZero() {
+			continue
+		}
+		n, ok := networks[ep.NetworkID]
+		if !ok {
+			if n, err = d.networks.Get(ep.NetworkID); err != nil {
+				if err == store.ErrKeyNotFound {
+					continue
+				}
+				return false, err
+			}
+			networks[ep.NetworkID] = n
+		}
+		if mode, err := n.Mode(); err != nil || mode == ModeVeth {
+			continue
+		}
+		nv, err := n.Vlan()
+		if err != nil {
+			continue
+		}
+		// the endpoint stays on the parent it joined on
+		if nv.Parent != "" && ep.Host.ParentEth != "" {
+			nv = d.onParent(nv, ep.Host.ParentEth)
+		}
+		if nv == v {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// connectSlave gives the endpoint a slave of the vlan device, it returns the
+// slave name and the function rolling the join back
+func (d *Driver) connectSlave(ep *Endpoint, v Vlan, mode string) (string, *EndpointHost, func(), error) {
+	if d.slaves == nil {
+		return "", nil, nil, fmt.Errorf("mode %s needs the %s datapath", mode, DatapathBridge)
+	}
+
+	name := ep.SlaveName()
+	unlockVlan := d.lockVlan(v)
+	created, err := d.slaves.Connect(v, mode, ep.EndpointID, name, d.endpointMac(ep, v, mode))
+	unlockVlan()
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	host := &EndpointHost{
+		Hostname:  d.hostname,
+		ParentEth: d.parentEth(v),
+		Veth:      name,
+		Devices:   d.slaves.Devices(v),
+		JoinedAt:  time.Now(),
+	}
+	rollback := func() {
+		defer d.lockVlan(v)()
+		if err := d.slaves.Rollback(v, ep.EndpointID, name, created); err != nil {
+			logrus.WithFields(logrus.Fields{"endpoint": ep.EndpointID, "created": created, "err": err}).Warn("roll back join error")
+		}
+	}
+	return name, host, rollback, nil
+}
+
+// endpointMac is the mac the frames of the endpoint leave with, ipvlan
+// endpoints have none of their own and use the one of the parent eth
+func (d *Driver) endpointMac(ep *Endpoint, v Vlan, mode string) net.HardwareAddr {
+	if !ipvlanMode(mode) {
+		return ep.VethDstMacAddress()
+	}
+	parent, err := netlink.LinkByName(d.parentEth(v))
+	if err != nil {
+		return nil
+	}
+	return parent.Attrs().HardwareAddr
+}
+
+// release tears down the devices of a vlan no endpoint of this host uses
+func (d *Driver) release(v Vlan, mode string) error {
+	defer d.lockVlan(v)()
+	if mode != ModeVeth && d.slaves != nil {
+		return d.slaves.Release(v)
+	}
+	return d.datapath.Release(v)
+}
@@ -2,8 +2,10 @@ package driver
 
 import (
 	"encoding/json"
+	"path"
 	"strings"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/docker/libkv/store"
 )
 
@@ -13,6 +15,7 @@ var (
 )
 
 func setDefaultRootChains(prefix string) {
+	rootChains = []string{}
 	for _, key := range strings.Split(prefix, "/") {
 		if key != "" {
 			rootChains = append(rootChains, key)
@@ -25,6 +28,13 @@ func normalize(keys ...string) string {
 	return strings.Join(append(rootChains, keys...), "/")
 }
 
+// directoryEntry tells whether kv is a directory listed along with its
+// records, boltdb lists the directory key once the cache or a watch wrote it.
+// Records are never empty.
+func directoryEntry(kv *store.KVPair) bool {
+	return len(kv.Value) == 0
+}
+
 type Networks struct {
 	s store.Store
 }
@@ -35,15 +45,37 @@ func (ns Networks) Get(id string) (*Network, error) {
 		return nil, err
 	}
 
-	var network *Network
-	if err := json.Unmarshal(kv.Value, &network); err != nil {
+	network, _, err := decodeNetwork(kv.Value)
+	return network, err
+}
+
+func (ns Networks) List() ([]*Network, error) {
+	kvs, err := ns.s.List(normalize("network"))
+	if err != nil {
+		if err == store.ErrKeyNotFound {
+			return []*Network{}, nil
+		}
 		return nil, err
 	}
-	return network, nil
+
+	networks := make([]*Network, 0, len(kvs))
+	for _, kv := range kvs {
+		if directoryEntry(kv) {
+			continue
+		}
+		network, _, err := decodeNetwork(kv.Value)
+		if err != nil {
+			// a broken or newer record must not block the others
+			logrus.WithFields(logrus.Fields{"key": kv.Key, "err": err}).Warn("skip undecodable network record")
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
 }
 
 func (ns Networks) Put(network *Network) error {
-	data, err := json.Marshal(network)
+	data, err := json.Marshal(newNetworkRecord(network))
 	if err != nil {
 		return err
 	}
@@ -64,15 +96,36 @@ func (es Endpoints) Get(id string) (*Endpoint, error) {
 		return nil, err
 	}
 
-	var endpoint *Endpoint
-	if err := json.Unmarshal(kv.Value, &endpoint); err != nil {
+	endpoint, _, err := decodeEndpoint(kv.Value)
+	return endpoint, err
+}
+
+func (es Endpoints) List() ([]*Endpoint, error) {
+	kvs, err := es.s.List(normalize("endpoint"))
+	if err != nil {
+		if err == store.ErrKeyNotFound {
+			return []*Endpoint{}, nil
+		}
 		return nil, err
 	}
-	return endpoint, nil
+
+	endpoints := make([]*Endpoint, 0, len(kvs))
+	for _, kv := range kvs {
+		if directoryEntry(kv) {
+			continue
+		}
+		endpoint, _, err := decodeEndpoint(kv.Value)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"key": kv.Key, "err": err}).Warn("skip undecodable endpoint record")
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
 }
 
 func (es Endpoints) Put(endpoint *Endpoint) error {
-	data, err := json.Marshal(endpoint)
+	data, err := json.Marshal(newEndpointRecord(endpoint))
 	if err != nil {
 		return err
 	}
@@ -82,3 +135,137 @@ func (es Endpoints) Put(endpoint *Endpoint) error {
 func (es Endpoints) Delete(id string) error {
 	return es.s.Delete(normalize("endpoint", id))
 }
+
+// Parents indexes the networks with a Parent option, the parent/<network>
+// key holds the vlan of the network with its Parent selector. Joins only look
+// for networks sharing a parent eth once the index is not empty.
+type Parents struct {
+	s store.Store
+}
+
+// List maps the ids of the networks with a Parent option to their vlans
+func (ps Parents) List() (map[string]Vlan, error) {
+	kvs, err := ps.s.List(normalize("parent"))
+	if err != nil {
+		if err == store.ErrKeyNotFound {
+			return map[string]Vlan{}, nil
+		}
+		return nil, err
+	}
+
+	vlans := make(map[string]Vlan, len(kvs))
+	for _, kv := range kvs {
+		if directoryEntry(kv) {
+			continue
+		}
+		var v Vlan
+		if err := json.Unmarshal(kv.Value, &v); err != nil {
+			logrus.WithFields(logrus.Fields{"key": kv.Key, "err": err}).Warn("skip undecodable parent record")
+			continue
+		}
+		// zookeeper lists child names, other backends full keys
+		vlans[path.Base(kv.Key)] = v
+	}
+	return vlans, nil
+}
+
+func (ps Parents) Put(networkID string, v Vlan) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ps.s.Put(normalize("parent", networkID), data, nil)
+}
+
+func (ps Parents) Delete(networkID string) error {
+	if err := ps.s.Delete(normalize("parent", networkID)); err != nil && err != store.ErrKeyNotFound {
+		return err
+	}
+	return nil
+}
+
+type Tunnels struct {
+	s store.Store
+}
+
+func (ts Tunnels) List() ([]*Tunnel, error) {
+	kvs, err := ts.s.List(normalize("tunnel"))
+	if err != nil {
+		if err == store.ErrKeyNotFound {
+			return []*Tunnel{}, nil
+		}
+		return nil, err
+	}
+
+	tunnels := make([]*Tunnel, 0, len(kvs))
+	for _, kv := range kvs {
+		var tunnel *Tunnel
+		if err := json.Unmarshal(kv.Value, &tunnel); err != nil {
+			return nil, err
+		}
+		tunnels = append(tunnels, tunnel)
+	}
+	return tunnels, nil
+}
+
+func (ts Tunnels) Put(tunnel *Tunnel) error {
+	data, err := json.Marshal(tunnel)
+	if err != nil {
+		return err
+	}
+	return ts.s.Put(normalize("tunnel", tunnel.EndpointID), data, nil)
+}
+
+func (ts Tunnels) Delete(id string) error {
+	if err := ts.s.Delete(normalize("tunnel", id)); err != nil && err != store.ErrKeyNotFound {
+		return err
+	}
+	return nil
+}
+
+// Addresses indexes the ipv4 addresses of the endpoints, the
+// address/<network>/<ip> key holds the id of the endpoint joined last with
+// that address
+type Addresses struct {
+	s store.Store
+}
+
+func addressKey(networkID, ip string) string {
+	return normalize("address", networkID, ip)
+}
+
+// Claim records endpointID as the owner of ip
+func (as Addresses) Claim(networkID, ip, endpointID string) error {
+	return as.s.Put(addressKey(networkID, ip), []byte(endpointID), nil)
+}
+
+// Owner returns the endpoint owning ip, empty if none
+func (as Addresses) Owner(networkID, ip string) (string, error) {
+	kv, err := as.s.Get(addressKey(networkID, ip))
+	if err != nil {
+		if err == store.ErrKeyNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(kv.Value), nil
+}
+
+// Release drops the owner of ip if endpointID still owns it
+func (as Addresses) Release(networkID, ip, endpointID string) error {
+	key := addressKey(networkID, ip)
+	kv, err := as.s.Get(key)
+	if err != nil {
+		if err == store.ErrKeyNotFound {
+			return nil
+		}
+		return err
+	}
+	if string(kv.Value) != endpointID {
+		return nil
+	}
+	if _, err := as.s.AtomicDelete(key, kv); err != nil && err != store.ErrKeyNotFound {
+		return err
+	}
+	return nil
+}
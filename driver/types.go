@@ -5,20 +5,113 @@ import (
 	"fmt"
 	"github.com/docker/go-plugins-helpers/network"
 	"github.com/docker/libnetwork/netlabel"
+	"github.com/omega/vlan-netplugin/nl"
 	"net"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var (
 	errVlanIdRequired  = errors.New(`opt "VlanId" must be specified`)
 	errVlanIdIsInvalid = errors.New(`opt "VlanId" invalid, must 0 < VlanId < 4096`)
+	errVniRequired     = errors.New(`opt "Vni" must be specified`)
+	errVniIsInvalid    = errors.New(`opt "Vni" invalid, must 0 < Vni < 16777216`)
+	errModeIsInvalid   = errors.New(`opt "Mode" invalid, must be veth, macvlan, ipvlan-l2 or ipvlan-l3`)
+
+	errOuterVlanIdIsInvalid   = errors.New(`opt "OuterVlanId" invalid, must 0 < OuterVlanId < 4096`)
+	errOuterProtocolIsInvalid = errors.New(`opt "OuterProtocol" invalid, must be 802.1ad or 802.1Q`)
+	errTrunkNeedsVeth         = errors.New(`opt "TrunkVlans" needs mode veth`)
+	errParentIsInvalid        = errors.New(`opt "Parent" invalid, must be an interface name or subnet:<cidr>`)
+)
+
+const (
+	Protocol8021AD = "802.1ad"
+	Protocol8021Q  = "802.1Q"
+)
+
+// maxTrunkVlans caps the vlans an endpoint trunks, the bridge datapath
+// creates a vlan device and a bridge for each of them
+const maxTrunkVlans = 64
+
+// Vlan identifies the vlan devices of a network. A QinQ vlan stacks the Id
+// tag on the service tag Outer pushed with OuterProtocol, Outer is 0 for a
+// plain 802.1Q vlan. Parent is the Parent option of the network, resolved to
+// the parent eth on a host, and empty for the default parent eth.
+type Vlan struct {
+	Id            int
+	Outer         int
+	OuterProtocol string
+	Parent        string
+}
+
+// String is the vlan part of the device names, <vid> or s<outer>.<vid> for
+// an 802.1ad service tag and q<outer>.<vid> for an 802.1Q one
+func (v Vlan) String() string {
+	if v.Outer == 0 {
+		return strconv.Itoa(v.Id)
+	}
+	return fmt.Sprintf("%s.%d", v.outerString(), v.Id)
+}
+
+func (v Vlan) outerString() string {
+	if v.OuterProtocol == Protocol8021Q {
+		return fmt.Sprintf("q%d", v.Outer)
+	}
+	return fmt.Sprintf("s%d", v.Outer)
+}
+
+const (
+	// ModeVeth connects a veth pair through the datapath, the default
+	ModeVeth = "veth"
+	// ModeMacvlan hands the container a macvlan of the vlan device
+	ModeMacvlan = "macvlan"
+	// ModeIpvlanL2 and ModeIpvlanL3 hand the container an ipvlan of the vlan
+	// device, every container shares the mac of the parent eth
+	ModeIpvlanL2 = "ipvlan-l2"
+	ModeIpvlanL3 = "ipvlan-l3"
 )
 
+// ipvlanMode tells whether the endpoints of mode share the parent eth mac
+func ipvlanMode(mode string) bool {
+	return mode == ModeIpvlanL2 || mode == ModeIpvlanL3
+}
+
 type Network struct {
 	*network.CreateNetworkRequest
 }
 type Endpoint struct {
 	*network.CreateEndpointRequest
+
+	// result of the gateway arp resolution on join, nil if not verified
+	GatewayReachable *bool
+	GatewayMac       string
+
+	// Host is set on join, it tells where the endpoint interface lives
+	Host *EndpointHost
+}
+
+// EndpointHost records the host an endpoint joined on and the devices its
+// interface was built from, LeftAt is set once it left
+type EndpointHost struct {
+	Hostname  string
+	ParentEth string
+	// Veth is the host side of the veth pair, PeerVeth the container side
+	// before docker renames it
+	Veth     string
+	PeerVeth string
+	// Devices are the vlan devices and bridges the veth is attached to
+	Devices  []string
+	JoinedAt time.Time
+	LeftAt   time.Time
+}
+
+// Tunnel records on which vxlan tunnel endpoint a joined endpoint is reachable
+type Tunnel struct {
+	NetworkID  string
+	EndpointID string
+	MacAddress string
+	Vtep       string
 }
 
 func (n *Network) VlanId() (vlanId int, err error) {
@@ -57,24 +150,231 @@ func (n *Network) VlanId() (vlanId int, err error) {
 	return 0, errVlanIdRequired
 }
 
+// Vlan returns the vlan of the network
+func (n *Network) Vlan() (Vlan, error) {
+	vlanId, err := n.VlanId()
+	if err != nil {
+		return Vlan{}, err
+	}
+	return n.vlan(vlanId)
+}
+
+// vlan returns the vlan of the network given its vlan id
+func (n *Network) vlan(vlanId int) (Vlan, error) {
+	v, err := n.outerVlan()
+	if err != nil {
+		return Vlan{}, err
+	}
+	if v.Parent, err = n.parent(); err != nil {
+		return Vlan{}, err
+	}
+	v.Id = vlanId
+	return v, nil
+}
+
+// parent returns the Parent option, an interface name or a subnet selector
+// resolved on each host
+func (n *Network) parent() (string, error) {
+	parent := optionString(n.Options, "Parent")
+	if strings.HasPrefix(parent, nl.SubnetSelector) {
+		if _, _, err := net.ParseCIDR(strings.TrimPrefix(parent, nl.SubnetSelector)); err != nil {
+			return "", errParentIsInvalid
+		}
+		return parent, nil
+	}
+	if len(parent) > maxIfNameLen || strings.ContainsAny(parent, "/: ") {
+		return "", errParentIsInvalid
+	}
+	return parent, nil
+}
+
+// outerVlan returns the service tag of a QinQ network, OuterVlanId is absent
+// for a plain 802.1Q network
+func (n *Network) outerVlan() (v Vlan, err error) {
+	genericOpt, ok := n.Options[netlabel.GenericData].(map[string]interface{})
+	if !ok {
+		return v, nil
+	}
+
+	o, exists := genericOpt["OuterVlanId"]
+	if !exists {
+		return v, nil
+	}
+	switch o.(type) {
+	case string:
+		v.Outer, err = strconv.Atoi(o.(string))
+	case float64:
+		v.Outer = int(o.(float64))
+	case int:
+		v.Outer = o.(int)
+	default:
+		return v, errOuterVlanIdIsInvalid
+	}
+	if err != nil || v.Outer <= 0 || v.Outer >= 4096 {
+		return Vlan{}, errOuterVlanIdIsInvalid
+	}
+
+	switch protocol, _ := genericOpt["OuterProtocol"].(string); {
+	case protocol == "" || strings.EqualFold(protocol, Protocol8021AD):
+		v.OuterProtocol = Protocol8021AD
+	case strings.EqualFold(protocol, Protocol8021Q):
+		v.OuterProtocol = Protocol8021Q
+	default:
+		return Vlan{}, errOuterProtocolIsInvalid
+	}
+	return v, nil
+}
+
+// Mode returns how the endpoints of the network are given their interface
+func (n *Network) Mode() (string, error) {
+	genericOpt, ok := n.Options[netlabel.GenericData].(map[string]interface{})
+	if !ok {
+		return ModeVeth, nil
+	}
+
+	mode, _ := genericOpt["Mode"].(string)
+	switch mode {
+	case "", ModeVeth:
+		return ModeVeth, nil
+	case ModeMacvlan, ModeIpvlanL2, ModeIpvlanL3:
+		return mode, nil
+	}
+	return "", errModeIsInvalid
+}
+
+func (n *Network) Vni() (vni int, err error) {
+	if n.Options == nil {
+		return 0, errVniRequired
+	}
+
+	genericOpt, ok := n.Options[netlabel.GenericData].(map[string]interface{})
+	if !ok {
+		return 0, errVniRequired
+	}
+
+	v, exists := genericOpt["Vni"]
+	if !exists {
+		return 0, errVniRequired
+	}
+
+	switch v.(type) {
+	case string:
+		vni, err = strconv.Atoi(v.(string))
+	case float64:
+		vni = int(v.(float64))
+	case int:
+		vni = v.(int)
+	default:
+		return 0, errVniIsInvalid
+	}
+
+	if err != nil || vni <= 0 || vni >= 1<<24 {
+		return 0, errVniIsInvalid
+	}
+	return vni, nil
+}
+
 func (n *Network) FindIPv4Data(addr string) (*network.IPAMData, error) {
+	return n.findIPAMData(n.IPv4Data, addr)
+}
+
+func (n *Network) FindIPv6Data(addr string) (*network.IPAMData, error) {
+	return n.findIPAMData(n.IPv6Data, addr)
+}
+
+func (n *Network) findIPAMData(pools []*network.IPAMData, addr string) (*network.IPAMData, error) {
 	ip, _, err := net.ParseCIDR(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, ipv4data := range n.IPv4Data {
-		_, subnet, err := net.ParseCIDR(ipv4data.Pool)
+	for _, data := range pools {
+		_, subnet, err := net.ParseCIDR(data.Pool)
 		if err != nil {
 			return nil, err
 		}
 		if subnet.Contains(ip) {
-			return ipv4data, nil
+			return data, nil
 		}
 	}
 	return nil, fmt.Errorf("cannot find matched subnet: ip=%s network=%s", addr, n.NetworkID)
 }
 
+// TrunkVlans are the vlans the interface of ep carries tagged besides the
+// untagged vlan of the network, the TrunkVlans option of the endpoint replaces
+// the one of the network. ep is nil to check the network option.
+func (n *Network) TrunkVlans(ep *Endpoint) ([]Vlan, error) {
+	spec := optionString(n.Options, "TrunkVlans")
+	if ep != nil {
+		if epSpec := optionString(ep.Options, "TrunkVlans"); epSpec != "" {
+			spec = epSpec
+		}
+	}
+	if spec == "" {
+		return nil, nil
+	}
+
+	if mode, err := n.Mode(); err != nil || mode != ModeVeth {
+		return nil, errTrunkNeedsVeth
+	}
+	v, err := n.Vlan()
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := parseVlanRanges(spec)
+	if err != nil {
+		return nil, fmt.Errorf(`opt "TrunkVlans" %v`, err)
+	}
+
+	var trunks []Vlan
+	seen := map[int]bool{}
+	for _, r := range ranges {
+		for vlanId := r.Start; vlanId <= r.End; vlanId++ {
+			if vlanId == v.Id {
+				return nil, fmt.Errorf(`opt "TrunkVlans" must not contain vlan %d of the network`, vlanId)
+			}
+			if seen[vlanId] {
+				continue
+			}
+			seen[vlanId] = true
+			if len(seen) > maxTrunkVlans {
+				return nil, fmt.Errorf(`opt "TrunkVlans" must not contain more than %d vlans`, maxTrunkVlans)
+			}
+			t := v
+			t.Id = vlanId
+			trunks = append(trunks, t)
+		}
+	}
+	return trunks, nil
+}
+
+// Gateways returns the ipv4 and ipv6 gateway of the subnets holding the
+// endpoint addresses, nil if the endpoint has no address of that family
+func (n *Network) Gateways(ep *Endpoint) (gateway, gatewayIPv6 net.IP, err error) {
+	if ep.Interface.Address != "" {
+		ipv4data, err := n.FindIPv4Data(ep.Interface.Address)
+		if err != nil {
+			return nil, nil, err
+		}
+		if gateway, _, err = net.ParseCIDR(ipv4data.Gateway); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if ep.Interface.AddressIPv6 != "" {
+		ipv6data, err := n.FindIPv6Data(ep.Interface.AddressIPv6)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ipv6data.Gateway != "" {
+			if gatewayIPv6, _, err = net.ParseCIDR(ipv6data.Gateway); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return gateway, gatewayIPv6, nil
+}
+
 func (e *Endpoint) GenerateMacAddress() {
 	if e.Interface.MacAddress != "" {
 		return
@@ -84,9 +384,13 @@ func (e *Endpoint) GenerateMacAddress() {
 	hw[0] = 0x7a
 	hw[1] = 0x42
 
-	ip, _, _ := net.ParseCIDR(e.Interface.Address)
-
-	copy(hw[2:], ip.To4())
+	if ip, _, err := net.ParseCIDR(e.Interface.Address); err == nil {
+		copy(hw[2:], ip.To4())
+	} else if ip, _, err := net.ParseCIDR(e.Interface.AddressIPv6); err == nil {
+		// ipv6 only endpoint, take the lowest 4 bytes of its address
+		hw[1] = 0x43
+		copy(hw[2:], ip.To16()[12:])
+	}
 	e.Interface.MacAddress = hw.String()
 }
 
@@ -94,6 +398,16 @@ func (e *Endpoint) VethName() string {
 	return "v" + e.EndpointID[:12]
 }
 
+// SlaveName is the name of the macvlan or ipvlan given to the container in place of a veth
+func (e *Endpoint) SlaveName() string {
+	return "vs" + e.EndpointID[:12]
+}
+
+// TrunkName is the host side vlan device of a trunked vlan, it fits IFNAMSIZ
+func (e *Endpoint) TrunkName(vlanId int) string {
+	return fmt.Sprintf("t%s.%d", e.EndpointID[:8], vlanId)
+}
+
 func (e *Endpoint) VethSourceMacAddress() net.HardwareAddr {
 	mac, _ := net.ParseMAC("FE:FF:FF:FF:FF:FF")
 	return mac
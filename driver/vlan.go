@@ -10,7 +10,9 @@ import (
 	"github.com/omega/vlan-netplugin/nl"
 	"github.com/vishvananda/netlink"
 	"net"
-	"sync"
+	"os"
+	"strconv"
+	"time"
 )
 
 const (
@@ -18,10 +20,43 @@ const (
 )
 
 type DriverOption struct {
-	Store     store.Store
-	Prefix    string
-	ParentEth string
-	SendArp   bool
+	Store  store.Store
+	Prefix string
+	// Scope is the capability scope reported to docker, network.LocalScope
+	// when the records are kept in an on-host store
+	Scope string
+	// Cache serves network and endpoint records from memory while the store
+	// is unreachable and queues the writes meanwhile
+	Cache bool
+	// Hostname is recorded on the endpoints joined on this host, defaults to
+	// the kernel hostname
+	Hostname string
+	// VlanPools are the vlan ids allocated to networks created without a
+	// VlanId, per tenant given by the network option named TenantLabel
+	VlanPools   *VlanPools
+	TenantLabel string
+	ParentEth   string
+	SendArp     bool
+	SendNA      bool
+	SendNS      bool
+	SendGarp    bool
+	GarpReply   bool
+	// ArpCount and ArpInterval control how many times each arp is sent
+	ArpCount    int
+	ArpInterval time.Duration
+	// ProbeIP sends RFC 5227 arp probes before join and fails it on conflict
+	ProbeIP       bool
+	ProbeCount    int
+	ProbeInterval time.Duration
+	ProbeWait     time.Duration
+	// VerifyGateway waits for the gateway arp reply on join, RequireGateway
+	// fails the join if none arrives within GatewayTimeout
+	VerifyGateway  bool
+	RequireGateway bool
+	GatewayTimeout time.Duration
+	Datapath       string
+	VlanBridge     string
+	OvsBridge      string
 }
 
 func (o DriverOption) Eth() (dev string, err error) {
@@ -39,40 +74,152 @@ func New(option DriverOption) (*Driver, error) {
 	if err != nil {
 		return nil, err
 	}
+	if option.ArpCount <= 0 {
+		option.ArpCount = 1
+	}
+
+	dp, err := newDatapath(option, dev)
+	if err != nil {
+		return nil, err
+	}
+	// slaves of a vlan device on a bridge or ovs port would never see a frame
+	var slaves *slaveDatapath
+	if _, ok := dp.(*bridgeDatapath); ok {
+		slaves = newSlaveDatapath(dev)
+	}
+	if option.Scope == "" {
+		option.Scope = network.GlobalScope
+	}
+	if option.Hostname == "" {
+		if option.Hostname, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	if option.TenantLabel == "" {
+		option.TenantLabel = defaultTenantLabel
+	}
 	setDefaultRootChains(option.Prefix)
-	return &Driver{
-		dev:       dev,
-		networks:  Networks{option.Store},
-		endpoints: Endpoints{option.Store},
-		sendArp:   option.SendArp,
-	}, nil
+	s := option.Store
+	if option.Cache {
+		s = newCacheStore(s, normalize("network"), normalize("endpoint"))
+	}
+	d := &Driver{
+		dev:            dev,
+		hostname:       option.Hostname,
+		scope:          option.Scope,
+		networks:       Networks{s},
+		endpoints:      Endpoints{s},
+		addresses:      Addresses{s},
+		parents:        Parents{s},
+		vlans:          Vlans{option.Store},
+		vlanPools:      option.VlanPools,
+		tenantLabel:    option.TenantLabel,
+		sendArp:        option.SendArp,
+		sendNA:         option.SendNA,
+		sendNS:         option.SendNS,
+		sendGarp:       option.SendGarp,
+		garpReply:      option.GarpReply,
+		arpCount:       option.ArpCount,
+		arpInterval:    option.ArpInterval,
+		probeIP:        option.ProbeIP,
+		probeCount:     option.ProbeCount,
+		probeInterval:  option.ProbeInterval,
+		probeWait:      option.ProbeWait,
+		verifyGateway:  option.VerifyGateway,
+		requireGateway: option.RequireGateway,
+		gatewayTimeout: option.GatewayTimeout,
+		datapath:       dp,
+		slaves:         slaves,
+	}
+	if slaves != nil {
+		slaves.joined = d.slaveJoined
+	}
+	return d, nil
 }
 
 type Driver struct {
-	dev       string
-	sendArp   bool
-	networks  Networks
-	endpoints Endpoints
-
-	sync.Mutex
+	dev            string
+	hostname       string
+	scope          string
+	sendArp        bool
+	sendNA         bool
+	sendNS         bool
+	sendGarp       bool
+	garpReply      bool
+	arpCount       int
+	arpInterval    time.Duration
+	probeIP        bool
+	probeCount     int
+	probeInterval  time.Duration
+	probeWait      time.Duration
+	verifyGateway  bool
+	requireGateway bool
+	gatewayTimeout time.Duration
+	networks       Networks
+	endpoints      Endpoints
+	addresses      Addresses
+	parents        Parents
+	vlans          Vlans
+	vlanPools      *VlanPools
+	tenantLabel    string
+	datapath       datapath
+	// slaves gives the endpoints of macvlan networks their interface, nil
+	// unless the datapath is bridge
+	slaves *slaveDatapath
+
+	// vlanLocks serializes the device setup and teardown of a vlan,
+	// endpointLocks the join and leave of an endpoint. An endpoint lock is
+	// always taken before a vlan lock, see lockVlan for QinQ vlans.
+	vlanLocks     keyedMutex
+	endpointLocks keyedMutex
 }
 
-func (*Driver) GetCapabilities() (*network.CapabilitiesResponse, error) {
+func (d *Driver) GetCapabilities() (*network.CapabilitiesResponse, error) {
 	return &network.CapabilitiesResponse{
-		Scope: network.GlobalScope,
+		Scope: d.scope,
 	}, nil
 }
 
 func (d *Driver) CreateNetwork(r *network.CreateNetworkRequest) error {
 	n := &Network{r}
-
-	_, err := n.VlanId()
+	mode, err := n.Mode()
 	if err != nil {
 		return err
 	}
+	// only the bridge datapath creates the vlan devices slaves live on
+	if mode != ModeVeth && d.slaves == nil {
+		return fmt.Errorf("mode %s needs the %s datapath", mode, DatapathBridge)
+	}
+
+	// every host is asked to create a global network, keep the vlan id the
+	// first one allocated
+	if stored, err := d.networks.Get(r.NetworkID); err == nil {
+		if _, err := stored.Vlan(); err == nil {
+			return nil
+		}
+	} else if err != store.ErrKeyNotFound {
+		return err
+	}
 
-	return d.networks.Put(n)
+	v, err := d.reserveVlan(n)
+	if err != nil {
+		return err
+	}
 
+	if _, err = n.TrunkVlans(nil); err == nil && v.Parent != "" {
+		err = d.parents.Put(n.NetworkID, v)
+	}
+	if err == nil {
+		err = d.networks.Put(n)
+	}
+	if err != nil {
+		if v.Parent != "" {
+			d.parents.Delete(n.NetworkID)
+		}
+		d.vlans.Release(v, n.NetworkID)
+		return err
+	}
+	return nil
 }
 
 func (*Driver) AllocateNetwork(*network.AllocateNetworkRequest) (*network.AllocateNetworkResponse, error) {
@@ -80,13 +227,36 @@ func (*Driver) AllocateNetwork(*network.AllocateNetworkRequest) (*network.Alloca
 }
 
 func (d *Driver) DeleteNetwork(r *network.DeleteNetworkRequest) error {
-	if _, err := d.networks.Get(r.NetworkID); err != nil {
+	n, err := d.networks.Get(r.NetworkID)
+	if err != nil {
 		if err == store.ErrKeyNotFound {
 			return nil
 		}
 		return err
 	}
-	return d.networks.Delete(r.NetworkID)
+	if err := d.networks.Delete(r.NetworkID); err != nil {
+		return err
+	}
+
+	v, err := n.Vlan()
+	if err != nil {
+		return nil
+	}
+	if err := d.vlans.Release(v, n.NetworkID); err != nil {
+		logrus.WithFields(logrus.Fields{"network": n.NetworkID, "vlan": v, "err": err}).Warn("cannot release vlan id")
+	}
+	if v.Parent != "" {
+		if err := d.parents.Delete(n.NetworkID); err != nil {
+			logrus.WithFields(logrus.Fields{"network": n.NetworkID, "err": err}).Warn("cannot delete parent record")
+		}
+	}
+
+	// no devices were created for a parent this host does not have
+	if v, err = d.hostVlan(n); err != nil {
+		return nil
+	}
+	mode, _ := n.Mode()
+	return d.release(v, mode)
 }
 
 func (*Driver) FreeNetwork(*network.FreeNetworkRequest) error {
@@ -97,8 +267,8 @@ func (d *Driver) CreateEndpoint(r *network.CreateEndpointRequest) (*network.Crea
 
 	logrus.Info("Create a endpoint ")
 
-	if r.Interface.Address == "" {
-		return nil, errors.New("CreateEndpointRequest.Interface.Address must be specified")
+	if r.Interface.Address == "" && r.Interface.AddressIPv6 == "" {
+		return nil, errors.New("CreateEndpointRequest.Interface.Address or AddressIPv6 must be specified")
 	}
 
 	if v, exists := r.Options[netlabel.PortMap]; exists {
@@ -107,8 +277,25 @@ func (d *Driver) CreateEndpoint(r *network.CreateEndpointRequest) (*network.Crea
 		}
 	}
 
-	ep := &Endpoint{r}
-	if ep.Interface.MacAddress == "" {
+	n, err := d.networks.Get(r.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := n.Mode()
+	if err != nil {
+		return nil, err
+	}
+
+	ep := &Endpoint{CreateEndpointRequest: r}
+	if _, err := n.TrunkVlans(ep); err != nil {
+		return nil, err
+	}
+	if ipvlanMode(mode) {
+		// the ipvlan takes the mac of the parent eth, it cannot be changed
+		if ep.Interface.MacAddress != "" {
+			return nil, fmt.Errorf("mode %s does not support custom mac addresses", mode)
+		}
+	} else if ep.Interface.MacAddress == "" {
 		ep.GenerateMacAddress()
 	}
 
@@ -128,11 +315,24 @@ func (d *Driver) CreateEndpoint(r *network.CreateEndpointRequest) (*network.Crea
 
 func (d *Driver) DeleteEndpoint(r *network.DeleteEndpointRequest) error {
 
-	_, err := d.endpoints.Get(r.EndpointID)
+	ep, err := d.endpoints.Get(r.EndpointID)
 	if err != nil {
+		// the endpoint of a dead host may be purged already
+		if err == store.ErrKeyNotFound {
+			return nil
+		}
 		return err
 	}
 
+	// the address index keeps the endpoint unless it left with --send-garp
+	if ep.Interface != nil && ep.Interface.Address != "" {
+		if ip, _, err := net.ParseCIDR(ep.Interface.Address); err == nil {
+			if err := d.addresses.Release(ep.NetworkID, ip.String(), ep.EndpointID); err != nil {
+				logrus.WithFields(logrus.Fields{"endpoint": ep.EndpointID, "err": err}).Warn("cannot release address owner")
+			}
+		}
+	}
+
 	return d.endpoints.Delete(r.EndpointID)
 }
 
@@ -152,6 +352,14 @@ func (d *Driver) EndpointInfo(r *network.InfoRequest) (*network.InfoResponse, er
 			}
 		}
 	}
+	if ep.GatewayReachable != nil {
+		resp.Value["GatewayReachable"] = strconv.FormatBool(*ep.GatewayReachable)
+		resp.Value["GatewayMac"] = ep.GatewayMac
+	}
+	if ep.Host != nil {
+		resp.Value["Host"] = ep.Host.Hostname
+		resp.Value["HostVeth"] = ep.Host.Veth
+	}
 	return &resp, nil
 }
 
@@ -162,119 +370,524 @@ func (d *Driver) Join(r *network.JoinRequest) (*network.JoinResponse, error) {
 	if err != nil {
 		return nil, err
 	}
-	vlanId, err := n.VlanId()
+	v, err := d.hostVlan(n)
 	if err != nil {
 		return nil, err
 	}
-
-	vlanName := func() string {
-		return fmt.Sprintf("%s.%d", d.dev, vlanId)
+	if owner, err := d.sharedVlan(n, v); err != nil {
+		return nil, err
+	} else if owner != "" {
+		return nil, vlanInUseError{v, owner}
 	}
-	bridgeName := func() string {
-		return fmt.Sprintf("br0.%d", vlanId)
+	mode, err := n.Mode()
+	if err != nil {
+		return nil, err
 	}
 
+	defer d.endpointLocks.Lock(r.EndpointID)()
+
 	ep, err := d.endpoints.Get(r.EndpointID)
 	if err != nil {
 		return nil, err
 	}
-	ipv4data, err := n.FindIPv4Data(ep.Interface.Address)
+	gateway, gatewayIPv6, err := n.Gateways(ep)
 	if err != nil {
 		return nil, err
 	}
-	gateway, _, err := net.ParseCIDR(ipv4data.Gateway)
+	trunks, err := d.hostTrunks(n, ep, v)
 	if err != nil {
 		return nil, err
 	}
 
-	d.Lock()
-	defer d.Unlock()
+	// ipvlan l3 endpoints are routed by the host, they are not on the vlan
+	mac := d.endpointMac(ep, v, mode)
+	onLink := mode != ModeIpvlanL3
+	parent := d.parentEth(v)
 
-	vlanDev, err := nl.CreateVlan(d.dev, vlanId, vlanName())
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		if err != nil {
-			nl.DestroyDevice(vlanName())
+	// probe and verify-gateway listen on the parent eth, which sees the
+	// replies of a QinQ vlan with the outer tag still on
+	if d.probeIP && onLink && v.Outer == 0 && ep.Interface.Address != "" {
+		if err = d.probe(ep, mac, v); err != nil {
+			return nil, err
 		}
-	}()
+	}
 
-	bridgeDev, err := nl.CreateBridge(bridgeName())
+	var (
+		srcName  string
+		rollback func()
+	)
+	if mode == ModeVeth {
+		srcName, ep.Host, rollback, err = d.connectVeth(ep, v, trunks)
+	} else {
+		srcName, ep.Host, rollback, err = d.connectSlave(ep, v, mode)
+	}
 	if err != nil {
 		return nil, err
 	}
+	// only the devices created by this join are rolled back, those found
+	// may carry the traffic of other endpoints
 	defer func() {
 		if err != nil {
-			nl.DestroyDevice(bridgeName())
+			rollback()
 		}
 	}()
 
-	linkSetUp := nl.UpSetter()
-	for _, link := range []netlink.Link{bridgeDev, vlanDev} {
-		if err = linkSetUp(link); err != nil {
+	if onLink && ep.Interface.Address != "" {
+		cip, _, arpErr := net.ParseCIDR(ep.Interface.Address)
+		if arpErr != nil {
+			err = arpErr
+			return nil, err
+		}
+
+		if d.sendGarp {
+			if arpErr := nl.Repeat(d.arpCount, d.arpInterval, func() error {
+				return nl.SendGratuitousArp(d.garpOp(), mac, mac, cip, parent, v.Id, v.outerTags()...)
+			}); arpErr != nil {
+				logrus.WithFields(logrus.Fields{"container ip": cip, "err": arpErr}).Info("send gratuitous arp error ")
+			}
+		}
+
+		if d.sendArp && gateway != nil {
+			if arpErr := nl.Repeat(d.arpCount, d.arpInterval, func() error {
+				return nl.SendArpRequest(mac, cip, gateway, parent, v.Id, v.outerTags()...)
+			}); arpErr != nil {
+				logrus.WithFields(logrus.Fields{"container ip": cip, "gateway": gateway, "err": arpErr}).Info("send arp error ")
+			}
+		}
+
+		if d.verifyGateway && gateway != nil && v.Outer == 0 {
+			if err = d.checkGateway(ep, mac, cip, gateway, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if d.sendNA && onLink && ep.Interface.AddressIPv6 != "" {
+		cip, _, ndpErr := net.ParseCIDR(ep.Interface.AddressIPv6)
+		if ndpErr != nil {
+			err = ndpErr
 			return nil, err
 		}
+
+		if ndpErr := nl.SendUnsolicitedNeighborAdvertisement(mac, cip, parent, v.Id, v.outerTags()...); ndpErr != nil {
+			logrus.WithFields(logrus.Fields{"container ip": cip, "err": ndpErr}).Info("send neighbor advertisement error ")
+		}
+
+		if d.sendNS && gatewayIPv6 != nil {
+			if ndpErr := nl.SendNeighborSolicitation(mac, cip, gatewayIPv6, parent, v.Id, v.outerTags()...); ndpErr != nil {
+				logrus.WithFields(logrus.Fields{"container ip": cip, "gateway": gatewayIPv6, "err": ndpErr}).Info("send neighbor solicitation error ")
+			}
+		}
 	}
 
-	linkSetMaster := nl.JoinNetworkSetter(bridgeDev)
-	if err = linkSetMaster(vlanDev); err != nil {
+	if err = d.endpoints.Put(ep); err != nil {
 		return nil, err
 	}
+	if d.sendGarp && ep.Interface.Address != "" {
+		if cip, _, err := net.ParseCIDR(ep.Interface.Address); err == nil {
+			if err := d.addresses.Claim(ep.NetworkID, cip.String(), ep.EndpointID); err != nil {
+				logrus.WithFields(logrus.Fields{"endpoint": ep.EndpointID, "err": err}).Warn("cannot claim address")
+			}
+		}
+	}
+
+	if !onLink {
+		return &network.JoinResponse{
+			InterfaceName: network.InterfaceName{SrcName: srcName, DstPrefix: "eth"},
+			StaticRoutes:  defaultRoutes(ep),
+		}, nil
+	}
+	return &network.JoinResponse{
+		InterfaceName: network.InterfaceName{SrcName: srcName, DstPrefix: "eth"},
+		Gateway:       ipString(gateway),
+		GatewayIPv6:   ipString(gatewayIPv6),
+	}, nil
+}
+
+// routeConnected is the libnetwork route type of a route through the
+// interface without next hop
+const routeConnected = 1
+
+// defaultRoutes route every destination through the interface, an ipvlan l3
+// endpoint has no gateway to resolve
+func defaultRoutes(ep *Endpoint) []*network.StaticRoute {
+	var routes []*network.StaticRoute
+	if ep.Interface.Address != "" {
+		routes = append(routes, &network.StaticRoute{Destination: "0.0.0.0/0", RouteType: routeConnected})
+	}
+	if ep.Interface.AddressIPv6 != "" {
+		routes = append(routes, &network.StaticRoute{Destination: "::/0", RouteType: routeConnected})
+	}
+	return routes
+}
 
+// connectVeth connects the host side of a veth pair through the datapath and
+// trunks the given vlans on it, it returns the container side name and the
+// function rolling the join back
+func (d *Driver) connectVeth(ep *Endpoint, v Vlan, trunks []Vlan) (string, *EndpointHost, func(), error) {
 	veths, err := nl.CreateVethPeer(ep.VethName())
 	if err != nil {
-		return nil, err
+		return "", nil, nil, err
 	}
-	defer func() {
-		if err != nil {
-			nl.DestroyDevice(veths[0].Attrs().Name)
+
+	var created []string
+	trunkCreated := map[Vlan][]string{}
+	rollback := func() {
+		for t, created := range trunkCreated {
+			unlockVlan := d.lockVlan(t)
+			if err := d.datapath.Rollback(t, ep.TrunkName(t.Id), created); err != nil {
+				logrus.WithFields(logrus.Fields{"endpoint": ep.EndpointID, "created": created, "err": err}).Warn("roll back join error")
+			}
+			unlockVlan()
 		}
-	}()
+
+		defer d.lockVlan(v)()
+		if err := d.datapath.Rollback(v, veths[0].Attrs().Name, created); err != nil {
+			logrus.WithFields(logrus.Fields{"endpoint": ep.EndpointID, "created": created, "err": err}).Warn("roll back join error")
+		}
+	}
 
 	//	origin := veths[0] //peer in host , vxxxx
 	//	local := veths[1]  //peer in container , vvxxx
 
-	if err = nl.Set(
-		veths[0],
-		nl.MacSetter(ep.VethSourceMacAddress()),
-		nl.JoinNetworkSetter(bridgeDev),
-		nl.UpSetter(),
-	); err != nil {
-		return nil, err
+	if err := nl.Set(veths[0], nl.MacSetter(ep.VethSourceMacAddress())); err != nil {
+		rollback()
+		return "", nil, nil, err
 	}
 
-	if err = nl.Set(veths[1], nl.MacSetter(ep.VethDstMacAddress())); err != nil {
-		return nil, err
+	unlockVlan := d.lockVlan(v)
+	created, err = d.datapath.Connect(v, veths[0])
+	unlockVlan()
+	if err != nil {
+		rollback()
+		return "", nil, nil, err
 	}
 
-	if d.sendArp {
-		cip, _, arpErr := net.ParseCIDR(ep.Interface.Address)
-		if arpErr != nil {
-			return nil, err
+	devices := d.datapath.Devices(v)
+	for _, t := range trunks {
+		unlockVlan := d.lockVlan(t)
+		trunkCreated[t], err = d.datapath.Trunk(t, veths[0], ep.TrunkName(t.Id))
+		unlockVlan()
+		if err != nil {
+			rollback()
+			return "", nil, nil, err
 		}
+		devices = appendMissing(devices, d.datapath.Devices(t)...)
+	}
+
+	if err := nl.Set(veths[1], nl.MacSetter(ep.VethDstMacAddress())); err != nil {
+		rollback()
+		return "", nil, nil, err
+	}
+	return veths[1].Attrs().Name, d.endpointHost(veths, d.parentEth(v), devices), rollback, nil
+}
 
-		if arpErr := nl.SendArpRequest(ep.VethDstMacAddress(), cip, gateway, d.dev, vlanId); arpErr != nil {
-			logrus.WithFields(logrus.Fields{"container ip": cip, "gateway": gateway, "err": arpErr}).Info("send arp error ")
+// disconnectTrunks undoes the Trunk of the vlans trunked on the veth of ep
+func (d *Driver) disconnectTrunks(ep *Endpoint, trunks []Vlan) {
+	for _, t := range trunks {
+		unlockVlan := d.lockVlan(t)
+		if err := d.datapath.Disconnect(t, ep.TrunkName(t.Id)); err != nil {
+			logrus.WithFields(logrus.Fields{"endpoint": ep.EndpointID, "vlan": t, "err": err}).Warn("cannot release trunked vlan")
 		}
+		unlockVlan()
 	}
+}
 
-	return &network.JoinResponse{
-		InterfaceName: network.InterfaceName{veths[1].Attrs().Name, "eth"},
-		Gateway:       gateway.String(),
-	}, nil
+func appendMissing(list []string, items ...string) []string {
+	for _, item := range items {
+		found := false
+		for _, l := range list {
+			if l == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// hostVlan returns the vlan of the network with its Parent option resolved
+// on this host, it fails if this host has no such parent
+func (d *Driver) hostVlan(n *Network) (Vlan, error) {
+	v, err := n.Vlan()
+	if err != nil {
+		return v, err
+	}
+	hv, err := d.resolveParent(v)
+	if err != nil {
+		return Vlan{}, fmt.Errorf("parent %q of network %s not found on this host: %v", v.Parent, n.NetworkID, err)
+	}
+	return hv, nil
+}
+
+// resolveParent resolves the Parent selector of v to the parent eth on this
+// host
+func (d *Driver) resolveParent(v Vlan) (Vlan, error) {
+	if v.Parent == "" {
+		return v, nil
+	}
+	parent, err := nl.FindParentEth(v.Parent)
+	if err != nil {
+		return Vlan{}, err
+	}
+	return d.onParent(v, parent), nil
+}
+
+// sharedVlan returns the id of another network whose Parent selector differs
+// from the one of n but selects the same parent eth on this host for vlan v.
+// Networks with the same selector predating vlan reservation may share it.
+func (d *Driver) sharedVlan(n *Network, v Vlan) (string, error) {
+	raw, err := n.Vlan()
+	if err != nil {
+		return "", err
+	}
+	parents, err := d.parents.List()
+	if err != nil {
+		return "", err
+	}
+	for networkID, ov := range parents {
+		if networkID == n.NetworkID || ov == raw {
+			continue
+		}
+		if hv, err := d.resolveParent(ov); err == nil && hv == v {
+			return networkID, nil
+		}
+	}
+
+	// a selector naming the default parent eth shares the vlans of the
+	// networks without Parent option
+	if raw.Parent != "" && v.Parent == "" {
+		owner, err := d.vlans.Owner(v)
+		if err != nil {
+			return "", err
+		}
+		if owner != "" && owner != n.NetworkID {
+			return owner, nil
+		}
+	}
+	return "", nil
+}
+
+// onParent puts v on the given parent eth, the default one is left empty so
+// that its devices keep their names
+func (d *Driver) onParent(v Vlan, parent string) Vlan {
+	v.Parent = parent
+	if parent == d.dev {
+		v.Parent = ""
+	}
+	return v
+}
+
+func (d *Driver) parentEth(v Vlan) string {
+	if v.Parent != "" {
+		return v.Parent
+	}
+	return d.dev
+}
+
+// hostTrunks returns the trunked vlans of ep on the parent of v
+func (d *Driver) hostTrunks(n *Network, ep *Endpoint, v Vlan) ([]Vlan, error) {
+	trunks, err := n.TrunkVlans(ep)
+	for i := range trunks {
+		trunks[i].Parent = v.Parent
+	}
+	return trunks, err
+}
+
+// lockVlan locks v, and the outer vlan shared with the other vlans stacked
+// on the same outer device first
+func (d *Driver) lockVlan(v Vlan) func() {
+	if v.Outer == 0 {
+		return d.vlanLocks.Lock(v)
+	}
+	unlockOuter := d.vlanLocks.Lock(Vlan{Outer: v.Outer, OuterProtocol: v.OuterProtocol, Parent: v.Parent})
+	unlock := d.vlanLocks.Lock(v)
+	return func() {
+		unlock()
+		unlockOuter()
+	}
+}
+
+// endpointHost describes the interface of an endpoint joined on this host
+func (d *Driver) endpointHost(veths []*netlink.Veth, parent string, devices []string) *EndpointHost {
+	return &EndpointHost{
+		Hostname:  d.hostname,
+		ParentEth: parent,
+		Veth:      veths[0].Attrs().Name,
+		PeerVeth:  veths[1].Attrs().Name,
+		Devices:   devices,
+		JoinedAt:  time.Now(),
+	}
+}
+
+// leftHost marks the endpoint as left this host, the last host it was joined
+// on is kept
+func (d *Driver) leftHost(ep *Endpoint) {
+	if ep.Host == nil {
+		ep.Host = &EndpointHost{Hostname: d.hostname, ParentEth: d.dev}
+	}
+	ep.Host.LeftAt = time.Now()
+	if err := d.endpoints.Put(ep); err != nil {
+		logrus.WithFields(logrus.Fields{"endpoint": ep.EndpointID, "err": err}).Warn("cannot record endpoint leave")
+	}
 }
 
 func (d *Driver) Leave(r *network.LeaveRequest) error {
+	n, err := d.networks.Get(r.NetworkID)
+	if err != nil {
+		return err
+	}
+	v, err := n.Vlan()
+	if err != nil {
+		return err
+	}
+	mode, err := n.Mode()
+	if err != nil {
+		return err
+	}
+
+	defer d.endpointLocks.Lock(r.EndpointID)()
+
 	ep, err := d.endpoints.Get(r.EndpointID)
 	if err != nil {
 		return err
 	}
+	// leave the parent joined on, the Parent option may no longer resolve
+	if v.Parent != "" {
+		if ep.Host != nil && ep.Host.Hostname == d.hostname && ep.Host.ParentEth != "" {
+			v = d.onParent(v, ep.Host.ParentEth)
+		} else if v, err = d.hostVlan(n); err != nil {
+			return err
+		}
+	}
+
+	unlockVlan := d.lockVlan(v)
+	if mode == ModeVeth {
+		err = d.datapath.Disconnect(v, ep.VethName())
+	} else if d.slaves != nil {
+		err = d.slaves.Disconnect(v, ep.EndpointID, ep.SlaveName())
+	}
+	unlockVlan()
+	if err != nil {
+		return err
+	}
+	if trunks, _ := d.hostTrunks(n, ep, v); len(trunks) > 0 {
+		d.disconnectTrunks(ep, trunks)
+	}
+	d.leftHost(ep)
+
+	if d.sendGarp {
+		d.announceMigrated(ep, v)
+	}
+	return nil
+}
+
+// checkGateway resolves the gateway mac with arp and records the result on
+// the endpoint, an unreachable gateway usually means the vlan is not trunked
+// to the switch port of this host
+func (d *Driver) checkGateway(ep *Endpoint, srcMac net.HardwareAddr, ip, gateway net.IP, v Vlan) error {
+	mac, err := nl.ResolveArp(srcMac, ip, gateway, d.parentEth(v), v.Id, d.gatewayTimeout)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"gateway": gateway, "err": err}).Warn("resolve gateway error")
+		if d.requireGateway {
+			return fmt.Errorf("cannot resolve gateway %s on vlan %d: %v", gateway, v.Id, err)
+		}
+		return nil
+	}
 
-	d.Lock()
-	defer d.Unlock()
+	reachable := mac != nil
+	ep.GatewayReachable = &reachable
+	ep.GatewayMac = ""
+	if reachable {
+		ep.GatewayMac = mac.String()
+	}
+	if err := d.endpoints.Put(ep); err != nil {
+		return err
+	}
 
-	return nl.DestroyDevice(ep.VethName())
+	if !reachable {
+		logrus.WithFields(logrus.Fields{"gateway": gateway, "vlan": v.Id, "endpoint": ep.EndpointID}).Warn("gateway is not reachable")
+		if d.requireGateway {
+			return fmt.Errorf("gateway %s does not answer arp on vlan %d, is the vlan trunked to this host?", gateway, v.Id)
+		}
+	}
+	return nil
+}
+
+// probe fails if another host already owns the ipv4 address of the endpoint
+func (d *Driver) probe(ep *Endpoint, srcMac net.HardwareAddr, v Vlan) error {
+	ip, _, err := net.ParseCIDR(ep.Interface.Address)
+	if err != nil {
+		return err
+	}
+
+	mac, err := nl.ProbeArp(srcMac, ip, d.parentEth(v), v.Id, d.probeCount, d.probeInterval, d.probeWait)
+	if err != nil {
+		return err
+	}
+	if mac != nil {
+		logrus.WithFields(logrus.Fields{"ip": ip, "mac": mac, "vlan": v.Id}).Warn("duplicate ip detected")
+		return fmt.Errorf("ip %s is already in use by %s on vlan %d", ip, mac, v.Id)
+	}
+	return nil
+}
+
+func (d *Driver) garpOp() uint16 {
+	if d.garpReply {
+		return nl.ARP_REPLY
+	}
+	return nl.ARP_REQUEST
+}
+
+// announceMigrated sends gratuitous arp on behalf of the endpoint which took
+// over the ip of a leaving endpoint, so that switches and firewalls drop the
+// stale owner. The endpoint joined last with the ip is found in the address
+// index, which the leaving endpoint is dropped from if it still owns it. The
+// frame leaves with the mac of the parent eth, which keeps the new owner's
+// mac from being learned on this host's switch port.
+func (d *Driver) announceMigrated(ep *Endpoint, v Vlan) {
+	if ep.Interface.Address == "" {
+		return
+	}
+	ip, _, err := net.ParseCIDR(ep.Interface.Address)
+	if err != nil {
+		return
+	}
+
+	ownerID, err := d.addresses.Owner(ep.NetworkID, ip.String())
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"endpoint": ep.EndpointID, "err": err}).Warn("cannot get address owner")
+		return
+	}
+	if ownerID == "" || ownerID == ep.EndpointID {
+		if err := d.addresses.Release(ep.NetworkID, ip.String(), ep.EndpointID); err != nil {
+			logrus.WithFields(logrus.Fields{"endpoint": ep.EndpointID, "err": err}).Warn("cannot release address owner")
+		}
+		return
+	}
+	owner, err := d.endpoints.Get(ownerID)
+	if err != nil || owner.Interface == nil {
+		return
+	}
+
+	parent, err := netlink.LinkByName(d.parentEth(v))
+	if err != nil {
+		return
+	}
+	// an ipvlan owner has no mac of its own to announce
+	mac := owner.VethDstMacAddress()
+	if mac == nil {
+		return
+	}
+	logrus.WithFields(logrus.Fields{"ip": ip, "mac": mac, "endpoint": owner.EndpointID}).Info("announce migrated ip")
+	if err := nl.Repeat(d.arpCount, d.arpInterval, func() error {
+		return nl.SendGratuitousArp(d.garpOp(), parent.Attrs().HardwareAddr, mac, ip, parent.Attrs().Name, v.Id, v.outerTags()...)
+	}); err != nil {
+		logrus.WithFields(logrus.Fields{"ip": ip, "err": err}).Info("send gratuitous arp error ")
+	}
 }
 
 func (*Driver) DiscoverNew(*network.DiscoveryNotification) error {
@@ -296,3 +909,10 @@ func (*Driver) RevokeExternalConnectivity(*network.RevokeExternalConnectivityReq
 func (d *Driver) Type() string {
 	return driverType
 }
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
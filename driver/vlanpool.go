@@ -0,0 +1,359 @@
+package driver
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/libkv/store"
+	"github.com/docker/libnetwork/netlabel"
+)
+
+const defaultTenantLabel = "Tenant"
+
+// VlanRange is an inclusive range of vlan ids
+type VlanRange struct {
+	Start int
+	End   int
+}
+
+// VlanPools are the vlan ids networks created without a VlanId are given,
+// a tenant with its own ranges never falls back to the default ones
+type VlanPools struct {
+	Default []VlanRange
+	Tenants map[string][]VlanRange
+}
+
+// ParseVlanPools parses pools given as <ranges> or <tenant>=<ranges>, where
+// ranges are comma separated ids or <start>-<end>, e.g. "100-199" or
+// "tenantA=200-249,300"
+func ParseVlanPools(specs []string) (*VlanPools, error) {
+	pools := &VlanPools{Tenants: map[string][]VlanRange{}}
+	for _, spec := range specs {
+		tenant, ranges := "", spec
+		if i := strings.Index(spec, "="); i >= 0 {
+			tenant, ranges = strings.TrimSpace(spec[:i]), spec[i+1:]
+			if tenant == "" {
+				return nil, fmt.Errorf("vlan pool %q: empty tenant", spec)
+			}
+		}
+
+		parsed, err := parseVlanRanges(ranges)
+		if err != nil {
+			return nil, fmt.Errorf("vlan pool %q: %v", spec, err)
+		}
+		if tenant == "" {
+			pools.Default = append(pools.Default, parsed...)
+		} else {
+			pools.Tenants[tenant] = append(pools.Tenants[tenant], parsed...)
+		}
+	}
+
+	sortRanges(pools.Default)
+	for _, ranges := range pools.Tenants {
+		sortRanges(ranges)
+	}
+	return pools, nil
+}
+
+// parseVlanRanges parses comma separated vlan ids or <start>-<end> ranges
+func parseVlanRanges(ranges string) ([]VlanRange, error) {
+	var parsed []VlanRange
+	for _, r := range strings.Split(ranges, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		bounds := strings.SplitN(r, "-", 2)
+		if len(bounds) == 1 {
+			bounds = append(bounds, bounds[0])
+		}
+		start, err1 := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		end, err2 := strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err1 != nil || err2 != nil || start <= 0 || end >= 4096 || start > end {
+			return nil, fmt.Errorf("invalid range %q, must 0 < start <= end < 4096", r)
+		}
+		parsed = append(parsed, VlanRange{start, end})
+	}
+	return parsed, nil
+}
+
+// byStart sorts vlan ranges by their first id
+type byStart []VlanRange
+
+func (r byStart) Len() int           { return len(r) }
+func (r byStart) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byStart) Less(i, j int) bool { return r[i].Start < r[j].Start }
+
+func sortRanges(ranges []VlanRange) {
+	sort.Sort(byStart(ranges))
+}
+
+func (p *VlanPools) empty() bool {
+	return p == nil || (len(p.Default) == 0 && len(p.Tenants) == 0)
+}
+
+func (p *VlanPools) ranges(tenant string) []VlanRange {
+	if ranges, ok := p.Tenants[tenant]; ok && tenant != "" {
+		return ranges
+	}
+	return p.Default
+}
+
+type vlanInUseError struct {
+	vlan  Vlan
+	owner string
+}
+
+func (e vlanInUseError) Error() string {
+	return fmt.Sprintf("vlan %s is already used by network %s", e.vlan, e.owner)
+}
+
+type tagInUseError struct {
+	vlan  Vlan
+	owner string
+}
+
+func (e tagInUseError) Error() string {
+	tag := e.vlan.Id
+	if e.vlan.Outer != 0 {
+		tag = e.vlan.Outer
+	}
+	return fmt.Sprintf("802.1Q tag %d on the parent eth of vlan %s is already used by network %s", tag, e.vlan, e.owner)
+}
+
+// Vlans reserves vlans cluster wide, the vlan/<vlan> key, vlan/<vlan>@<parent>
+// for a network with a Parent option, holds the id of the network owning it.
+// It always talks to the store itself, a cached reservation is worthless.
+type Vlans struct {
+	s store.Store
+}
+
+func vlanKey(v Vlan) string {
+	if v.Parent == "" {
+		return normalize("vlan", v.String())
+	}
+	return normalize("vlan", v.String()+"@"+url.QueryEscape(v.Parent))
+}
+
+// Reserve claims v for networkID, it fails if another network owns it
+func (vs Vlans) Reserve(v Vlan, networkID string) error {
+	owner, err := reserveKey(vs.s, vlanKey(v), networkID)
+	if err == nil && owner != "" {
+		return vlanInUseError{v, owner}
+	}
+	return err
+}
+
+// Owner returns the network owning v, empty if none
+func (vs Vlans) Owner(v Vlan) (string, error) {
+	kv, err := vs.s.Get(vlanKey(v))
+	if err != nil {
+		if err == store.ErrKeyNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(kv.Value), nil
+}
+
+// Release frees v if networkID still owns it
+func (vs Vlans) Release(v Vlan, networkID string) error {
+	return releaseKey(vs.s, vlanKey(v), networkID)
+}
+
+// reserveKey creates key holding networkID, it returns the owner if
+// another network holds the key already
+func reserveKey(s store.Store, key, networkID string) (string, error) {
+	_, _, err := s.AtomicPut(key, []byte(networkID), nil, nil)
+	if err != store.ErrKeyExists {
+		return "", err
+	}
+
+	kv, err := s.Get(key)
+	if err != nil {
+		return "", err
+	}
+	if owner := string(kv.Value); owner != networkID {
+		return owner, nil
+	}
+	return "", nil
+}
+
+// releaseKey deletes key if networkID still holds it
+func releaseKey(s store.Store, key, networkID string) error {
+	kv, err := s.Get(key)
+	if err != nil {
+		if err == store.ErrKeyNotFound {
+			return nil
+		}
+		return err
+	}
+	if string(kv.Value) != networkID {
+		return nil
+	}
+	if _, err := s.AtomicDelete(key, kv); err != nil && err != store.ErrKeyNotFound {
+		return err
+	}
+	return nil
+}
+
+// Tenant returns the value of the network option or label named label
+func (n *Network) Tenant(label string) string {
+	return optionString(n.Options, label)
+}
+
+// optionString returns the string option name given by --opt, or else the
+// top level label or driver option of that name
+func optionString(options map[string]interface{}, name string) string {
+	if genericOpt, ok := options[netlabel.GenericData].(map[string]interface{}); ok {
+		if v, ok := genericOpt[name].(string); ok {
+			return v
+		}
+	}
+	v, _ := options[name].(string)
+	return v
+}
+
+// setVlanId records the allocated vlan id as if it was given by --opt VlanId
+func (n *Network) setVlanId(vlanId int) {
+	if n.Options == nil {
+		n.Options = map[string]interface{}{}
+	}
+	genericOpt, ok := n.Options[netlabel.GenericData].(map[string]interface{})
+	if !ok {
+		genericOpt = map[string]interface{}{}
+		n.Options[netlabel.GenericData] = genericOpt
+	}
+	genericOpt["VlanId"] = strconv.Itoa(vlanId)
+}
+
+// usedVlans maps the vlans of the stored networks to their network ids, it
+// covers networks created before vlans were reserved. A vlan is mapped both
+// with its Parent selector and as resolved on this host, so that selectors
+// naming the same parent eth collide.
+func (d *Driver) usedVlans() (map[Vlan]string, error) {
+	networks, err := d.networks.List()
+	if err != nil {
+		return nil, err
+	}
+
+	used := map[Vlan]string{}
+	for _, n := range networks {
+		if v, err := n.Vlan(); err == nil {
+			used[v] = n.NetworkID
+		}
+	}
+	for _, n := range networks {
+		if v, err := d.hostVlan(n); err == nil {
+			if _, ok := used[v]; !ok {
+				used[v] = n.NetworkID
+			}
+		}
+	}
+	return used, nil
+}
+
+// vlanOwner returns the network other than networkID using v, looked up
+// with the Parent selector of v and as resolved on this host
+func (d *Driver) vlanOwner(used map[Vlan]string, v Vlan, networkID string) (string, bool) {
+	if owner, ok := used[v]; ok && owner != networkID {
+		return owner, true
+	}
+	if hv, err := d.resolveParent(v); err == nil {
+		if owner, ok := used[hv]; ok && owner != networkID {
+			return owner, true
+		}
+	}
+	return "", false
+}
+
+// tagOwner returns the network other than networkID whose vlan device on the
+// parent eth carries the same 802.1Q tag as the one of v. A plain vlan and
+// the 802.1Q service tag of a QinQ vlan with that id are the same device, the
+// kernel refuses to create it twice.
+func (d *Driver) tagOwner(used map[Vlan]string, v Vlan, networkID string) (string, bool) {
+	if v.Outer != 0 {
+		if v.OuterProtocol != Protocol8021Q {
+			return "", false
+		}
+		return d.vlanOwner(used, Vlan{Id: v.Outer, Parent: v.Parent}, networkID)
+	}
+
+	parent := v.Parent
+	if hv, err := d.resolveParent(v); err == nil {
+		parent = hv.Parent
+	}
+	for u, owner := range used {
+		if owner == networkID || u.Outer != v.Id || u.OuterProtocol != Protocol8021Q {
+			continue
+		}
+		if u.Parent == v.Parent {
+			return owner, true
+		}
+		if hu, err := d.resolveParent(u); err == nil && hu.Parent == parent {
+			return owner, true
+		}
+	}
+	return "", false
+}
+
+// reserveVlan reserves the vlan of n, or allocates its vlan id from the pools
+// of its tenant if it has none. The pools are shared by all outer vlans and
+// parents.
+func (d *Driver) reserveVlan(n *Network) (Vlan, error) {
+	used, err := d.usedVlans()
+	if err != nil {
+		return Vlan{}, err
+	}
+
+	v, err := n.Vlan()
+	if err == nil {
+		if owner, ok := d.vlanOwner(used, v, n.NetworkID); ok {
+			return Vlan{}, vlanInUseError{v, owner}
+		}
+		if owner, ok := d.tagOwner(used, v, n.NetworkID); ok {
+			return Vlan{}, tagInUseError{v, owner}
+		}
+		return v, d.vlans.Reserve(v, n.NetworkID)
+	}
+	if err != errVlanIdRequired || d.vlanPools.empty() {
+		return Vlan{}, err
+	}
+	base, err := n.vlan(0)
+	if err != nil {
+		return Vlan{}, err
+	}
+
+	if owner, ok := d.tagOwner(used, base, n.NetworkID); ok {
+		return Vlan{}, tagInUseError{base, owner}
+	}
+
+	tenant := n.Tenant(d.tenantLabel)
+	for _, r := range d.vlanPools.ranges(tenant) {
+		for vlanId := r.Start; vlanId <= r.End; vlanId++ {
+			v := base
+			v.Id = vlanId
+			if _, ok := d.vlanOwner(used, v, n.NetworkID); ok {
+				continue
+			}
+			if _, ok := d.tagOwner(used, v, n.NetworkID); ok {
+				continue
+			}
+			if err := d.vlans.Reserve(v, n.NetworkID); err != nil {
+				if _, ok := err.(vlanInUseError); ok {
+					continue
+				}
+				return Vlan{}, err
+			}
+
+			n.setVlanId(vlanId)
+			logrus.WithFields(logrus.Fields{"network": n.NetworkID, "tenant": tenant, "vlan": v}).Info("allocate vlan id from pool")
+			return v, nil
+		}
+	}
+	return Vlan{}, fmt.Errorf("no free vlan id left in the pool of tenant %q", tenant)
+}
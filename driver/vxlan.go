@@ -0,0 +1,481 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libkv/store"
+	"github.com/omega/vlan-netplugin/nl"
+	"github.com/omega/vlan-netplugin/ovs"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	vxlanDriverType = "vxlan"
+	vxlanPortName   = "vxlan0"
+
+	// table 0 classifies packets into a VNI, table 1 forwards them by destination mac
+	vxlanClassifyTable = 0
+	vxlanForwardTable  = 1
+
+	multicastMac = "01:00:00:00:00:00/01:00:00:00:00:00"
+
+	// vxlanOverhead is the outer ethernet, ipv4, udp and vxlan header of a
+	// tunneled frame, the endpoint mtu is the parent eth's less that
+	vxlanOverhead = 50
+)
+
+type VxlanDriverOption struct {
+	Store     store.Store
+	Prefix    string
+	ParentEth string
+	Bridge    string
+	Vtep      string
+	Hostname  string
+}
+
+// LocalVtep returns the local tunnel endpoint address, defaults to the first ipv4
+// address of the parent eth
+func (o VxlanDriverOption) LocalVtep(dev string) (net.IP, error) {
+	if o.Vtep != "" {
+		ip := net.ParseIP(o.Vtep)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid vtep address %q", o.Vtep)
+		}
+		return ip, nil
+	}
+	return nl.FindIPv4Address(dev)
+}
+
+func NewVxlan(option VxlanDriverOption) (*VxlanDriver, error) {
+	dev, err := DriverOption{ParentEth: option.ParentEth}.Eth()
+	if err != nil {
+		return nil, err
+	}
+
+	vtep, err := option.LocalVtep(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	if option.Hostname == "" {
+		if option.Hostname, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	setDefaultRootChains(option.Prefix)
+	d := &VxlanDriver{
+		Driver: &Driver{
+			dev:       dev,
+			hostname:  option.Hostname,
+			scope:     network.GlobalScope,
+			networks:  Networks{option.Store},
+			endpoints: Endpoints{option.Store},
+			addresses: Addresses{option.Store},
+		},
+		store:   option.Store,
+		tunnels: Tunnels{option.Store},
+		vnis:    Vnis{option.Store},
+		bridge:  option.Bridge,
+		vtep:    vtep,
+	}
+
+	if err := d.setupBridge(); err != nil {
+		return nil, err
+	}
+
+	go d.watchTunnels()
+
+	return d, nil
+}
+
+// VxlanDriver stretches container networks across hosts with vxlan tunnels
+// terminated on an openvswitch bridge. Every network is keyed on its VNI, the
+// tunnel destination of each remote endpoint is set per flow (remote_ip=flow).
+type VxlanDriver struct {
+	*Driver
+
+	store     store.Store
+	tunnels   Tunnels
+	vnis      Vnis
+	bridge    string
+	vtep      net.IP
+	vxlanPort string
+
+	// flowLocks serializes the flow rewrites of a VNI
+	flowLocks keyedMutex
+}
+
+func (d *VxlanDriver) setupBridge() error {
+	if err := ovs.ExistsBridge(d.bridge); err != nil {
+		if err := ovs.AddBridge(d.bridge); err != nil {
+			return err
+		}
+	}
+	if err := ovs.SetFailMode(d.bridge, "secure"); err != nil {
+		return err
+	}
+	// the flows of a network are replaced in a bundle, which needs OpenFlow 1.4
+	if err := ovs.SetProtocols(d.bridge, "OpenFlow10", "OpenFlow13", "OpenFlow14"); err != nil {
+		return err
+	}
+
+	var err error
+	if ovs.ExistsPort(vxlanPortName) == nil {
+		d.vxlanPort, err = ovs.GetOvsPortNumber(d.bridge, vxlanPortName)
+	} else {
+		d.vxlanPort, err = ovs.AddVxlanPort(d.bridge, vxlanPortName)
+	}
+	if err != nil {
+		return err
+	}
+
+	return ovs.AddFlowsFromLines(d.bridge, []string{
+		fmt.Sprintf("table=%d,priority=0,actions=drop", vxlanClassifyTable),
+		fmt.Sprintf("table=%d,priority=100,in_port=%s,actions=resubmit(,%d)", vxlanClassifyTable, d.vxlanPort, vxlanForwardTable),
+		fmt.Sprintf("table=%d,priority=0,actions=drop", vxlanForwardTable),
+	})
+}
+
+// CreateNetwork reserves the VNI of the network, the flows of a network are
+// keyed on its VNI so two networks sharing one would wipe each other's flows
+func (d *VxlanDriver) CreateNetwork(r *network.CreateNetworkRequest) error {
+	n := &Network{r}
+
+	vni, err := n.Vni()
+	if err != nil {
+		return err
+	}
+
+	// networks created before VNIs were reserved hold no reservation
+	networks, err := d.networks.List()
+	if err != nil {
+		return err
+	}
+	for _, other := range networks {
+		if ovni, err := other.Vni(); err == nil && ovni == vni && other.NetworkID != n.NetworkID {
+			return vniInUseError{vni, other.NetworkID}
+		}
+	}
+	if err := d.vnis.Reserve(vni, n.NetworkID); err != nil {
+		return err
+	}
+
+	if err := d.networks.Put(n); err != nil {
+		d.vnis.Release(vni, n.NetworkID)
+		return err
+	}
+	return nil
+}
+
+func (d *VxlanDriver) DeleteNetwork(r *network.DeleteNetworkRequest) error {
+	n, err := d.networks.Get(r.NetworkID)
+	if err != nil {
+		if err == store.ErrKeyNotFound {
+			return nil
+		}
+		return err
+	}
+	if err := d.networks.Delete(r.NetworkID); err != nil {
+		return err
+	}
+	if vni, err := n.Vni(); err == nil {
+		return d.vnis.Release(vni, n.NetworkID)
+	}
+	return nil
+}
+
+func (d *VxlanDriver) Join(r *network.JoinRequest) (*network.JoinResponse, error) {
+	var err error
+
+	n, err := d.networks.Get(r.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	vni, err := n.Vni()
+	if err != nil {
+		return nil, err
+	}
+
+	defer d.endpointLocks.Lock(r.EndpointID)()
+
+	ep, err := d.endpoints.Get(r.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+	gateway, gatewayIPv6, err := n.Gateways(ep)
+	if err != nil {
+		return nil, err
+	}
+
+	veths, err := nl.CreateVethPeer(ep.VethName())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			ovs.DelPort(d.bridge, veths[0].Attrs().Name)
+			nl.DestroyDevice(veths[0].Attrs().Name)
+		}
+	}()
+
+	parent, err := netlink.LinkByName(d.dev)
+	if err != nil {
+		return nil, err
+	}
+	mtu := parent.Attrs().MTU - vxlanOverhead
+
+	if err = nl.Set(
+		veths[0],
+		nl.MacSetter(ep.VethSourceMacAddress()),
+		nl.MtuSetter(mtu),
+		nl.UpSetter(),
+	); err != nil {
+		return nil, err
+	}
+
+	if err = nl.Set(veths[1], nl.MacSetter(ep.VethDstMacAddress()), nl.MtuSetter(mtu)); err != nil {
+		return nil, err
+	}
+
+	if ovs.ExistsPort(veths[0].Attrs().Name) != nil {
+		if _, err = ovs.AddPort(d.bridge, veths[0].Attrs().Name); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = d.tunnels.Put(&Tunnel{
+		NetworkID:  n.NetworkID,
+		EndpointID: ep.EndpointID,
+		MacAddress: ep.Interface.MacAddress,
+		Vtep:       d.vtep.String(),
+	}); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			d.tunnels.Delete(ep.EndpointID)
+		}
+	}()
+
+	if err = d.syncFlows(n.NetworkID, vni); err != nil {
+		return nil, err
+	}
+
+	ep.Host = d.endpointHost(veths, d.dev, []string{d.bridge})
+	if err = d.endpoints.Put(ep); err != nil {
+		return nil, err
+	}
+
+	return &network.JoinResponse{
+		InterfaceName: network.InterfaceName{SrcName: veths[1].Attrs().Name, DstPrefix: "eth"},
+		Gateway:       ipString(gateway),
+		GatewayIPv6:   ipString(gatewayIPv6),
+	}, nil
+}
+
+func (d *VxlanDriver) Leave(r *network.LeaveRequest) error {
+	n, err := d.networks.Get(r.NetworkID)
+	if err != nil {
+		return err
+	}
+	vni, err := n.Vni()
+	if err != nil {
+		return err
+	}
+
+	defer d.endpointLocks.Lock(r.EndpointID)()
+
+	ep, err := d.endpoints.Get(r.EndpointID)
+	if err != nil {
+		return err
+	}
+
+	if ovs.ExistsPort(ep.VethName()) == nil {
+		if err := ovs.DelPort(d.bridge, ep.VethName()); err != nil {
+			return err
+		}
+	}
+	if err := nl.DestroyDevice(ep.VethName()); err != nil {
+		return err
+	}
+
+	if err := d.tunnels.Delete(ep.EndpointID); err != nil {
+		return err
+	}
+	d.leftHost(ep)
+
+	return d.syncFlows(n.NetworkID, vni)
+}
+
+func (d *VxlanDriver) Type() string {
+	return vxlanDriverType
+}
+
+// syncFlows rewrites every flow of the network, all of them share the VNI as
+// cookie so that they can be replaced as a whole
+func (d *VxlanDriver) syncFlows(networkID string, vni int) error {
+	defer d.flowLocks.Lock(vni)()
+
+	tunnels, err := d.tunnels.List()
+	if err != nil {
+		return err
+	}
+
+	var (
+		flows   []string
+		locals  []string
+		remotes = map[string]bool{}
+		cookie  = fmt.Sprintf("cookie=%#x", vni)
+	)
+	for _, t := range tunnels {
+		if t.NetworkID != networkID {
+			continue
+		}
+
+		if t.Vtep != d.vtep.String() {
+			remotes[t.Vtep] = true
+			flows = append(flows, fmt.Sprintf("%s,table=%d,priority=100,tun_id=%d,dl_dst=%s,actions=set_field:%s->tun_dst,output:%s",
+				cookie, vxlanForwardTable, vni, t.MacAddress, t.Vtep, d.vxlanPort))
+			continue
+		}
+
+		ep := &Endpoint{CreateEndpointRequest: &network.CreateEndpointRequest{EndpointID: t.EndpointID}}
+		ofport, err := ovs.GetOvsPortNumber(d.bridge, ep.VethName())
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"endpoint": t.EndpointID, "err": err}).Warn("cannot find ovs port of local endpoint")
+			continue
+		}
+		locals = append(locals, ofport)
+		flows = append(flows,
+			fmt.Sprintf("%s,table=%d,priority=100,in_port=%s,actions=set_field:%d->tun_id,resubmit(,%d)",
+				cookie, vxlanClassifyTable, ofport, vni, vxlanForwardTable),
+			fmt.Sprintf("%s,table=%d,priority=100,tun_id=%d,dl_dst=%s,actions=output:%s",
+				cookie, vxlanForwardTable, vni, t.MacAddress, ofport),
+		)
+	}
+
+	// broadcast and multicast received from the tunnel only go to local ports,
+	// those sent by local ports are flooded to every host of the network
+	floodLocal := []string{}
+	for _, ofport := range locals {
+		floodLocal = append(floodLocal, "output:"+ofport)
+	}
+	floodAll := append([]string{}, floodLocal...)
+	for vtep := range remotes {
+		floodAll = append(floodAll, fmt.Sprintf("set_field:%s->tun_dst,output:%s", vtep, d.vxlanPort))
+	}
+	flows = append(flows,
+		fmt.Sprintf("%s,table=%d,priority=60,tun_id=%d,in_port=%s,dl_dst=%s,actions=%s",
+			cookie, vxlanForwardTable, vni, d.vxlanPort, multicastMac, actions(floodLocal)),
+		fmt.Sprintf("%s,table=%d,priority=50,tun_id=%d,dl_dst=%s,actions=%s",
+			cookie, vxlanForwardTable, vni, multicastMac, actions(floodAll)),
+	)
+
+	if len(locals) == 0 {
+		return ovs.DelFlows(d.bridge, cookie+"/-1")
+	}
+	return ovs.ReplaceFlows(d.bridge, cookie+"/-1", flows)
+}
+
+type vniInUseError struct {
+	vni   int
+	owner string
+}
+
+func (e vniInUseError) Error() string {
+	return fmt.Sprintf("vni %d is already used by network %s", e.vni, e.owner)
+}
+
+// Vnis reserves VNIs cluster wide, the vni/<vni> key holds the id of the
+// network owning it
+type Vnis struct {
+	s store.Store
+}
+
+func vniKey(vni int) string {
+	return normalize("vni", strconv.Itoa(vni))
+}
+
+// Reserve claims vni for networkID, it fails if another network owns it
+func (vs Vnis) Reserve(vni int, networkID string) error {
+	owner, err := reserveKey(vs.s, vniKey(vni), networkID)
+	if err == nil && owner != "" {
+		return vniInUseError{vni, owner}
+	}
+	return err
+}
+
+// Release frees vni if networkID still owns it
+func (vs Vnis) Release(vni int, networkID string) error {
+	return releaseKey(vs.s, vniKey(vni), networkID)
+}
+
+func actions(actions []string) string {
+	if len(actions) == 0 {
+		return "drop"
+	}
+	return strings.Join(actions, ",")
+}
+
+// syncAllFlows resyncs the flows of every network holding a local endpoint
+func (d *VxlanDriver) syncAllFlows() {
+	tunnels, err := d.tunnels.List()
+	if err != nil {
+		logrus.WithField("err", err).Warn("cannot list tunnels")
+		return
+	}
+
+	synced := map[string]bool{}
+	for _, t := range tunnels {
+		if t.Vtep != d.vtep.String() || synced[t.NetworkID] {
+			continue
+		}
+		synced[t.NetworkID] = true
+
+		n, err := d.networks.Get(t.NetworkID)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"network": t.NetworkID, "err": err}).Warn("cannot get network")
+			continue
+		}
+		vni, err := n.Vni()
+		if err != nil {
+			continue
+		}
+
+		if err := d.syncFlows(n.NetworkID, vni); err != nil {
+			logrus.WithFields(logrus.Fields{"network": t.NetworkID, "err": err}).Warn("cannot sync vxlan flows")
+		}
+	}
+}
+
+// watchTunnels keeps the tunnel flows up to date while endpoints join or
+// leave on remote hosts
+func (d *VxlanDriver) watchTunnels() {
+	for {
+		if exists, _ := d.store.Exists(normalize("tunnel")); !exists {
+			if err := d.store.Put(normalize("tunnel"), nil, &store.WriteOptions{IsDir: true}); err != nil {
+				logrus.WithField("err", err).Warn("cannot create tunnel directory")
+			}
+		}
+
+		ch, err := d.store.WatchTree(normalize("tunnel"), nil)
+		if err != nil {
+			logrus.WithField("err", err).Warn("cannot watch tunnels, retry after 5 sec ...")
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		for range ch {
+			d.syncAllFlows()
+		}
+		time.Sleep(time.Second)
+	}
+}
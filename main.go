@@ -1,24 +1,26 @@
 package main
 
 import (
+	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
 	"github.com/docker/go-plugins-helpers/network"
-	"github.com/docker/libkv"
-	"github.com/docker/libkv/store"
-	"github.com/docker/libkv/store/zookeeper"
+	"github.com/docker/libkv/store/boltdb"
+	"github.com/docker/libkv/store/consul"
+	"github.com/docker/libkv/store/etcd"
 	"github.com/omega/vlan-netplugin/driver"
 	"github.com/opencontainers/runc/libcontainer/user"
-	"net/url"
 	"os"
-	"strings"
+	"time"
 )
 
 var Version string
 
 func init() {
 
-	zookeeper.Register()
+	etcd.Register()
+	consul.Register()
+	boltdb.Register()
 
 }
 
@@ -44,7 +46,7 @@ func main() {
 		logrus.SetOutput(os.Stderr)
 		level, err := logrus.ParseLevel(c.String("log-level"))
 		if err != nil {
-			logrus.Fatalf(err.Error())
+			logrus.Fatal(err.Error())
 		}
 		logrus.SetLevel(level)
 		return nil
@@ -54,12 +56,44 @@ func main() {
 		{
 			Name:  "start",
 			Usage: "start a vlan netplugin ",
-			Flags: []cli.Flag{
+			Flags: append(storeFlags(), []cli.Flag{
 				cli.StringFlag{
-					Name:   "cluster-store",
-					EnvVar: "NP_CLUSTER_STORE",
-					Value:  "zk://localhost:2181",
-					Usage:  "Set the cluster store",
+					Name:   "hostname",
+					EnvVar: "NP_HOSTNAME",
+					Usage:  "Set the hostname recorded on the joined endpoints, defaults to the kernel hostname",
+				},
+				cli.DurationFlag{
+					Name:   "heartbeat-interval",
+					EnvVar: "NP_HEARTBEAT_INTERVAL",
+					Value:  10 * time.Second,
+					Usage:  "Set how often the heartbeat key of this host is refreshed",
+				},
+				cli.DurationFlag{
+					Name:   "heartbeat-ttl",
+					EnvVar: "NP_HEARTBEAT_TTL",
+					Value:  30 * time.Second,
+					Usage:  "Set the ttl of the heartbeat key, a host is dead once its heartbeat is missing for that long",
+				},
+				cli.BoolFlag{
+					Name:   "purge-dead-hosts",
+					EnvVar: "NP_PURGE_DEAD_HOSTS",
+					Usage:  "Run for the leadership of purging the endpoints of dead hosts, needs --purge-grace",
+				},
+				cli.DurationFlag{
+					Name:   "purge-grace",
+					EnvVar: "NP_PURGE_GRACE",
+					Usage:  "Set how long the heartbeat of a host must be missing before its endpoints are purged, e.g. 1h",
+				},
+				cli.DurationFlag{
+					Name:   "purge-interval",
+					EnvVar: "NP_PURGE_INTERVAL",
+					Value:  time.Minute,
+					Usage:  "Set how often the leader looks for dead hosts",
+				},
+				cli.BoolFlag{
+					Name:   "purge-dry-run",
+					EnvVar: "NP_PURGE_DRY_RUN",
+					Usage:  "Only report the endpoints of dead hosts which would be purged",
 				},
 				cli.StringFlag{
 					Name:   "parent-eth",
@@ -72,42 +106,242 @@ func main() {
 					EnvVar: "NP_SEND_ARP",
 					Usage:  "send a request arp to the container's gateway",
 				},
-			},
+				cli.BoolFlag{
+					Name:   "verify-gateway",
+					EnvVar: "NP_VERIFY_GATEWAY",
+					Usage:  "wait for the arp reply of the container's gateway and record whether it is reachable",
+				},
+				cli.BoolFlag{
+					Name:   "require-gateway",
+					EnvVar: "NP_REQUIRE_GATEWAY",
+					Usage:  "fail the join when the gateway is not reachable or cannot be resolved, implies --verify-gateway",
+				},
+				cli.DurationFlag{
+					Name:   "gateway-timeout",
+					EnvVar: "NP_GATEWAY_TIMEOUT",
+					Value:  time.Second,
+					Usage:  "Set how long to wait for the arp reply of the gateway",
+				},
+				cli.BoolFlag{
+					Name:   "send-garp",
+					EnvVar: "NP_SEND_GARP",
+					Usage:  "send a gratuitous arp for the container's ip on join, and for a migrated ip on leave",
+				},
+				cli.BoolFlag{
+					Name:   "garp-reply",
+					EnvVar: "NP_GARP_REPLY",
+					Usage:  "send gratuitous arp as reply instead of request",
+				},
+				cli.IntFlag{
+					Name:   "arp-count",
+					EnvVar: "NP_ARP_COUNT",
+					Value:  1,
+					Usage:  "Set how many times each arp is sent",
+				},
+				cli.DurationFlag{
+					Name:   "arp-interval",
+					EnvVar: "NP_ARP_INTERVAL",
+					Value:  time.Second,
+					Usage:  "Set the interval between repeated arps",
+				},
+				cli.BoolFlag{
+					Name:   "probe-ip",
+					EnvVar: "NP_PROBE_IP",
+					Usage:  "probe the container's ip with arp before join, and fail the join if it is in use",
+				},
+				cli.IntFlag{
+					Name:   "probe-count",
+					EnvVar: "NP_PROBE_COUNT",
+					Value:  3,
+					Usage:  "Set how many arp probes are sent",
+				},
+				cli.DurationFlag{
+					Name:   "probe-interval",
+					EnvVar: "NP_PROBE_INTERVAL",
+					Value:  200 * time.Millisecond,
+					Usage:  "Set the interval between arp probes",
+				},
+				cli.DurationFlag{
+					Name:   "probe-wait",
+					EnvVar: "NP_PROBE_WAIT",
+					Value:  time.Second,
+					Usage:  "Set how long to wait for conflicts after the last arp probe",
+				},
+				cli.BoolTFlag{
+					Name:   "send-na",
+					EnvVar: "NP_SEND_NA",
+					Usage:  "send an unsolicited neighbor advertisement for the container's ipv6 address",
+				},
+				cli.BoolFlag{
+					Name:   "send-ns",
+					EnvVar: "NP_SEND_NS",
+					Usage:  "send a neighbor solicitation to the container's ipv6 gateway",
+				},
+				cli.StringSliceFlag{
+					Name:   "vlan-pool",
+					EnvVar: "NP_VLAN_POOL",
+					Usage:  "Allocate vlan ids from the pool to networks created without VlanId, given as 100-199 or <tenant>=200-249,300, may be repeated",
+				},
+				cli.StringFlag{
+					Name:   "tenant-label",
+					EnvVar: "NP_TENANT_LABEL",
+					Value:  "Tenant",
+					Usage:  "Set the network option or label naming the tenant whose vlan pool is used",
+				},
+				cli.StringFlag{
+					Name:   "datapath",
+					EnvVar: "NP_DATAPATH",
+					Value:  "bridge",
+					Usage:  "Set the datapath of vlan networks (options: bridge, vlan-bridge, ovs)",
+				},
+				cli.StringFlag{
+					Name:   "vlan-bridge",
+					EnvVar: "NP_VLAN_BRIDGE",
+					Value:  "br0",
+					Usage:  "Set the vlan filtering bridge for the vlan-bridge datapath",
+				},
+				cli.StringFlag{
+					Name:   "ovs-bridge",
+					EnvVar: "NP_OVS_BRIDGE",
+					Value:  "br-vlan",
+					Usage:  "Set the openvswitch bridge for the ovs datapath",
+				},
+				cli.BoolFlag{
+					Name:   "vxlan",
+					EnvVar: "NP_VXLAN",
+					Usage:  "Also serve the vxlan network driver",
+				},
+				cli.StringFlag{
+					Name:   "vxlan-bridge",
+					EnvVar: "NP_VXLAN_BRIDGE",
+					Value:  "br-vxlan",
+					Usage:  "Set the openvswitch bridge for vxlan networks",
+				},
+				cli.StringFlag{
+					Name:   "vtep",
+					EnvVar: "NP_VTEP",
+					Usage:  "Set the local vxlan tunnel endpoint address, defaults to the address of parent eth",
+				},
+			}...),
 			Action: func(c *cli.Context) error {
 
+				scope := network.GlobalScope
+				if c.String("scope") == scopeLocal {
+					if c.Bool("vxlan") {
+						return fmt.Errorf("vxlan networks need a cluster store, cannot run in local scope")
+					}
+					scope = network.LocalScope
+				}
+
 				clusterStore := c.String("cluster-store")
-				url, err := url.Parse(clusterStore)
+				s, prefix, err := newStore(c)
 				if err != nil {
-					logrus.Info("parse cluster-store:%s fail , error:%s", clusterStore, err.Error())
+					logrus.Infof("connect cluster-store:%s  fail , error:%s", clusterStore, err.Error())
 					return err
 				}
 
-				s, err := libkv.NewStore(store.Backend(url.Scheme), strings.Split(url.Host, ","), nil)
+				pools, err := driver.ParseVlanPools(c.StringSlice("vlan-pool"))
 				if err != nil {
-					logrus.Info("connect cluster-store:%s  fail , error:%s", clusterStore, err.Error())
 					return err
 				}
 
 				d, err := driver.New(driver.DriverOption{Store: s,
-					Prefix:    url.Path,
-					ParentEth: c.String("parent-eth"),
-					SendArp:   c.Bool("send-arp"),
+					Prefix:         prefix,
+					Scope:          scope,
+					Cache:          scope == network.GlobalScope && storeCache(c),
+					Hostname:       c.String("hostname"),
+					VlanPools:      pools,
+					TenantLabel:    c.String("tenant-label"),
+					ParentEth:      c.String("parent-eth"),
+					SendArp:        c.Bool("send-arp"),
+					SendNA:         c.Bool("send-na"),
+					SendNS:         c.Bool("send-ns"),
+					SendGarp:       c.Bool("send-garp"),
+					GarpReply:      c.Bool("garp-reply"),
+					ArpCount:       c.Int("arp-count"),
+					ArpInterval:    c.Duration("arp-interval"),
+					ProbeIP:        c.Bool("probe-ip"),
+					ProbeCount:     c.Int("probe-count"),
+					ProbeInterval:  c.Duration("probe-interval"),
+					ProbeWait:      c.Duration("probe-wait"),
+					VerifyGateway:  c.Bool("verify-gateway") || c.Bool("require-gateway"),
+					RequireGateway: c.Bool("require-gateway"),
+					GatewayTimeout: c.Duration("gateway-timeout"),
+					Datapath:       c.String("datapath"),
+					VlanBridge:     c.String("vlan-bridge"),
+					OvsBridge:      c.String("ovs-bridge"),
 				})
 				if err != nil {
-					logrus.WithFields(logrus.Fields{"store": s, "prefix": url.Path, "parenteth": c.String("parent-eth")}).Info("new vlan driver error ,error is %s")
+					logrus.WithFields(logrus.Fields{"store": s, "prefix": prefix, "parenteth": c.String("parent-eth")}).Infof("new vlan driver error ,error is %s", err)
 					return err
 				}
 
+				if err := d.Reconcile(); err != nil {
+					logrus.WithField("err", err).Warn("reconcile host devices error")
+				}
+
+				if scope == network.GlobalScope {
+					if err := d.StartHeartbeat(s, driver.HeartbeatOption{
+						Interval:      c.Duration("heartbeat-interval"),
+						TTL:           c.Duration("heartbeat-ttl"),
+						Purge:         c.Bool("purge-dead-hosts"),
+						Grace:         c.Duration("purge-grace"),
+						PurgeInterval: c.Duration("purge-interval"),
+						DryRun:        c.Bool("purge-dry-run"),
+					}); err != nil {
+						return err
+					}
+				}
+
 				group, err := user.CurrentGroup()
 				if err != nil {
 					return nil
 				}
 
-				if err := network.NewHandler(d).ServeUnix("vlan", group.Gid); err != nil {
+				errCh := make(chan error, 2)
+				go func() {
+					errCh <- network.NewHandler(d).ServeUnix(d.Type(), group.Gid)
+				}()
+
+				if c.Bool("vxlan") {
+					vd, err := driver.NewVxlan(driver.VxlanDriverOption{Store: s,
+						Prefix:    prefix,
+						ParentEth: c.String("parent-eth"),
+						Bridge:    c.String("vxlan-bridge"),
+						Vtep:      c.String("vtep"),
+						Hostname:  c.String("hostname"),
+					})
+					if err != nil {
+						logrus.WithFields(logrus.Fields{"bridge": c.String("vxlan-bridge"), "vtep": c.String("vtep")}).Infof("new vxlan driver error ,error is %s", err)
+						return err
+					}
+
+					go func() {
+						errCh <- network.NewHandler(vd).ServeUnix(vd.Type(), group.Gid)
+					}()
+				}
+
+				return <-errCh
+			},
+		},
+		{
+			Name:  "migrate",
+			Usage: "Upgrade every record under the store prefix to the current schema version",
+			Flags: append(storeFlags(), []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only report the records to upgrade",
+				},
+			}...),
+			Action: func(c *cli.Context) error {
+				s, prefix, err := newStore(c)
+				if err != nil {
+					logrus.Infof("connect cluster-store:%s  fail , error:%s", c.String("cluster-store"), err.Error())
 					return err
 				}
+				defer s.Close()
 
-				return nil
+				return driver.Migrate(s, prefix, c.Bool("dry-run"))
 			},
 		},
 	}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"net"
 	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/vishvananda/netlink"
@@ -14,9 +15,31 @@ const (
 	ARP_REQUEST = 1
 	ARP_REPLY   = 2
 
-	ETH_8021Q_TPID = 0x8100
+	ETH_8021Q_TPID  = 0x8100
+	ETH_8021AD_TPID = 0x88a8
 )
 
+// VlanTag is a tag pushed in front of the 802.1Q tag of a frame, the service
+// tag of a QinQ vlan
+type VlanTag struct {
+	TPID uint16
+	Id   int
+}
+
+// pushTags inserts the outer tags after the mac addresses of frame, the
+// first tag ends up outermost
+func pushTags(frame []byte, outer []VlanTag) []byte {
+	if len(outer) == 0 {
+		return frame
+	}
+	tagged := make([]byte, 0, len(frame)+4*len(outer))
+	tagged = append(tagged, frame[:12]...)
+	for _, tag := range outer {
+		tagged = append(tagged, byte(tag.TPID>>8), byte(tag.TPID), byte(tag.Id>>8), byte(tag.Id))
+	}
+	return append(tagged, frame[12:]...)
+}
+
 var (
 	ethAddrBroadcast   net.HardwareAddr
 	ethAddrUnspecified net.HardwareAddr
@@ -38,17 +61,17 @@ func htons(n uint16) uint16 {
 	return n<<8 + high
 }
 
-func createSocket() (int, error) {
-	return syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ARP)))
+func createSocket(proto uint16) (int, error) {
+	return syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(proto)))
 }
 
-func getAddress(dev string) (syscall.Sockaddr, error) {
+func getAddress(dev string, proto uint16) (syscall.Sockaddr, error) {
 	link, err := netlink.LinkByName(dev)
 	if err != nil {
 		return nil, err
 	}
 	return &syscall.SockaddrLinklayer{
-		Protocol: htons(syscall.ETH_P_ARP),
+		Protocol: htons(proto),
 		Ifindex:  link.Attrs().Index,
 	}, nil
 }
@@ -74,7 +97,7 @@ type arpPacket struct {
 	padding       [18]byte
 }
 
-func createArpPacket(op uint16, srcMac net.HardwareAddr, srcIP, dstIP net.IP, vlanId int) *arpPacket {
+func createArpPacket(op uint16, ethSrc, srcMac net.HardwareAddr, srcIP, dstIP net.IP, vlanId int) *arpPacket {
 	packet := &arpPacket{
 		TPID:          htons(ETH_8021Q_TPID),
 		VID:           htons(uint16(vlanId)),
@@ -86,9 +109,13 @@ func createArpPacket(op uint16, srcMac net.HardwareAddr, srcIP, dstIP net.IP, vl
 		Op:            htons(op),
 	}
 	copy(packet.DestHwAddr[:], ethAddrBroadcast)
-	copy(packet.SrcHwAddr[:], srcMac)
+	copy(packet.SrcHwAddr[:], ethSrc)
 	copy(packet.SndrHwAddr[:], srcMac)
-	copy(packet.RcptHwAddr[:], ethAddrUnspecified)
+	if op == ARP_REPLY && srcIP.Equal(dstIP) {
+		copy(packet.RcptHwAddr[:], srcMac) // gratuitous reply
+	} else {
+		copy(packet.RcptHwAddr[:], ethAddrUnspecified)
+	}
 	copy(packet.SndrIpAddr[:], srcIP.To4()) // 这里必须To4否则可能为兼容IPv6的格式，高位填充0导致copy内容出错
 	copy(packet.RcptIpAddr[:], dstIP.To4())
 	return packet
@@ -102,26 +129,50 @@ func buildArpPacketBuffer(packet *arpPacket) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
-func SendArpRequest(srcMac net.HardwareAddr, srcIP, dstIP net.IP, dev string, vlanId int) error {
-	socket, err := createSocket()
+// SendArp sends a broadcast arp packet on the vlan, ethSrc is the source of the
+// ethernet frame which may differ from the sender hardware address srcMac.
+// The outer tags are pushed in front of the vlan tag.
+func SendArp(op uint16, ethSrc, srcMac net.HardwareAddr, srcIP, dstIP net.IP, dev string, vlanId int, outer ...VlanTag) error {
+	socket, err := createSocket(syscall.ETH_P_ARP)
 	if err != nil {
 		logrus.Error("failed to create raw arp socket: ", err)
 		return err
 	}
 	defer syscall.Close(socket)
 
-	sockAddr, err := getAddress(dev)
+	sockAddr, err := getAddress(dev, syscall.ETH_P_ARP)
 	if err != nil {
 		logrus.Error("failed to bind arp socket address: ", err)
 		return err
 	}
 
-	buf, err := buildArpPacketBuffer(createArpPacket(ARP_REQUEST, srcMac, srcIP, dstIP, vlanId))
+	buf, err := buildArpPacketBuffer(createArpPacket(op, ethSrc, srcMac, srcIP, dstIP, vlanId))
 	if err != nil {
 		logrus.Error("faeild to create arp packet: ", err)
 		return err
 	}
 
-	logrus.WithField("src", srcIP).WithField("dst", dstIP).Debug("send arp request")
-	return syscall.Sendto(socket, buf, 0, sockAddr)
+	logrus.WithFields(logrus.Fields{"op": op, "src": srcIP, "dst": dstIP}).Debug("send arp")
+	return syscall.Sendto(socket, pushTags(buf, outer), 0, sockAddr)
+}
+
+func SendArpRequest(srcMac net.HardwareAddr, srcIP, dstIP net.IP, dev string, vlanId int, outer ...VlanTag) error {
+	return SendArp(ARP_REQUEST, srcMac, srcMac, srcIP, dstIP, dev, vlanId, outer...)
+}
+
+// SendGratuitousArp announces srcMac as the owner of ip, op is ARP_REQUEST or ARP_REPLY
+func SendGratuitousArp(op uint16, ethSrc, srcMac net.HardwareAddr, ip net.IP, dev string, vlanId int, outer ...VlanTag) error {
+	return SendArp(op, ethSrc, srcMac, ip, ip, dev, vlanId, outer...)
+}
+
+// Repeat calls send count times with interval between calls, it returns the last error
+func Repeat(count int, interval time.Duration, send func() error) error {
+	var err error
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		err = send()
+	}
+	return err
 }
@@ -0,0 +1,95 @@
+package nl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	nlk "github.com/vishvananda/netlink/nl"
+)
+
+// see linux/if_bridge.h
+const (
+	IFLA_BRIDGE_FLAGS     = 0
+	IFLA_BRIDGE_VLAN_INFO = 2
+
+	BRIDGE_FLAGS_MASTER = 1
+	BRIDGE_FLAGS_SELF   = 2
+
+	BRIDGE_VLAN_INFO_PVID     = 1 << 1
+	BRIDGE_VLAN_INFO_UNTAGGED = 1 << 2
+)
+
+func setBridgeOption(bridgeName, option, value string) error {
+	return ioutil.WriteFile(fmt.Sprintf("/sys/class/net/%s/bridge/%s", bridgeName, option), []byte(value), 0644)
+}
+
+func bridgeOption(bridgeName, option string) (string, error) {
+	value, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/bridge/%s", bridgeName, option))
+	return strings.TrimSpace(string(value)), err
+}
+
+// EnableVlanFiltering turns vlan filtering on for an existing bridge and
+// returns its default pvid, 0 if none. The default pvid is kept as the bridge
+// and its ports carry the untagged host traffic with it
+func EnableVlanFiltering(bridgeName string) (int, error) {
+	value, err := bridgeOption(bridgeName, "default_pvid")
+	if err != nil {
+		return 0, err
+	}
+	pvid, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := setBridgeOption(bridgeName, "vlan_filtering", "1"); err != nil {
+		return 0, err
+	}
+	logrus.WithField("bridge", bridgeName).Debug("enable bridge vlan filtering")
+	return pvid, nil
+}
+
+func bridgeVlanModify(cmd int, link netlink.Link, vlanId int, flags uint16) error {
+	req := nlk.NewNetlinkRequest(cmd, syscall.NLM_F_ACK)
+
+	msg := nlk.NewIfInfomsg(syscall.AF_BRIDGE)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	afSpec := nlk.NewRtAttr(nlk.IFLA_AF_SPEC, nil)
+	nlk.NewRtAttrChild(afSpec, IFLA_BRIDGE_FLAGS, nlk.Uint16Attr(BRIDGE_FLAGS_MASTER))
+
+	vlanInfo := make([]byte, 4)
+	nlk.NativeEndian().PutUint16(vlanInfo[0:2], flags)
+	nlk.NativeEndian().PutUint16(vlanInfo[2:4], uint16(vlanId))
+	nlk.NewRtAttrChild(afSpec, IFLA_BRIDGE_VLAN_INFO, vlanInfo)
+	req.AddData(afSpec)
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// BridgeVlanAdd adds the bridge port to a vlan, an access port takes the vlan
+// as its pvid and sends frames untagged, otherwise the port trunks the vlan
+func BridgeVlanAdd(link netlink.Link, vlanId int, access bool) error {
+	var flags uint16
+	if access {
+		flags = BRIDGE_VLAN_INFO_PVID | BRIDGE_VLAN_INFO_UNTAGGED
+	}
+
+	logrus.WithFields(
+		logrus.Fields{"name": link.Attrs().Name, "vlan": vlanId, "access": access},
+	).Debug("bridge port add vlan")
+	return bridgeVlanModify(syscall.RTM_SETLINK, link, vlanId, flags)
+}
+
+func BridgeVlanDel(link netlink.Link, vlanId int) error {
+	logrus.WithFields(
+		logrus.Fields{"name": link.Attrs().Name, "vlan": vlanId},
+	).Debug("bridge port del vlan")
+	return bridgeVlanModify(syscall.RTM_DELLINK, link, vlanId, 0)
+}
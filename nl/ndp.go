@@ -0,0 +1,135 @@
+package nl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	ICMPV6_NEIGHBOR_SOLICITATION  = 135
+	ICMPV6_NEIGHBOR_ADVERTISEMENT = 136
+
+	NDP_OPT_SOURCE_LL_ADDR = 1
+	NDP_OPT_TARGET_LL_ADDR = 2
+
+	NA_FLAG_OVERRIDE = 1 << 29
+
+	ipv6HeaderSize   = 40
+	ipv6NextICMPv6   = 58
+	ipv6NdpHopLimit  = 255
+	ipv6VersionShift = 28
+)
+
+var ipv6AllNodes = net.ParseIP("ff02::1")
+
+// solicitedNodeAddress returns the solicited-node multicast address of ip and its ethernet mapping
+func solicitedNodeAddress(ip net.IP) (net.IP, net.HardwareAddr) {
+	ip = ip.To16()
+	addr := net.ParseIP("ff02::1:ff00:0")
+	copy(addr[13:], ip[13:])
+	return addr, multicastHwAddr(addr)
+}
+
+// multicastHwAddr maps an ipv6 multicast address to 33:33:xx:xx:xx:xx
+func multicastHwAddr(ip net.IP) net.HardwareAddr {
+	hw := net.HardwareAddr{0x33, 0x33, 0, 0, 0, 0}
+	copy(hw[2:], ip.To16()[12:])
+	return hw
+}
+
+func checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func icmpv6Checksum(src, dst net.IP, icmp []byte) uint16 {
+	pseudo := &bytes.Buffer{}
+	pseudo.Write(src.To16())
+	pseudo.Write(dst.To16())
+	binary.Write(pseudo, binary.BigEndian, uint32(len(icmp)))
+	pseudo.Write([]byte{0, 0, 0, ipv6NextICMPv6})
+	pseudo.Write(icmp)
+	return checksum(pseudo.Bytes())
+}
+
+// createNdpPacket builds an 802.1Q tagged ethernet frame carrying an ICMPv6
+// neighbor discovery message with a single link-layer address option
+func createNdpPacket(icmpType uint8, flags uint32, srcMac, dstMac net.HardwareAddr, srcIP, dstIP, target net.IP, vlanId int) []byte {
+	optType := uint8(NDP_OPT_SOURCE_LL_ADDR)
+	if icmpType == ICMPV6_NEIGHBOR_ADVERTISEMENT {
+		optType = NDP_OPT_TARGET_LL_ADDR
+	}
+
+	icmp := &bytes.Buffer{}
+	icmp.Write([]byte{icmpType, 0, 0, 0}) // type, code, checksum
+	binary.Write(icmp, binary.BigEndian, flags)
+	icmp.Write(target.To16())
+	icmp.Write([]byte{optType, 1})
+	icmp.Write(srcMac)
+	payload := icmp.Bytes()
+	binary.BigEndian.PutUint16(payload[2:4], icmpv6Checksum(srcIP, dstIP, payload))
+
+	frame := &bytes.Buffer{}
+	frame.Write(dstMac)
+	frame.Write(srcMac)
+	binary.Write(frame, binary.BigEndian, uint16(ETH_8021Q_TPID))
+	binary.Write(frame, binary.BigEndian, uint16(vlanId))
+	binary.Write(frame, binary.BigEndian, uint16(syscall.ETH_P_IPV6))
+
+	binary.Write(frame, binary.BigEndian, uint32(6<<ipv6VersionShift))
+	binary.Write(frame, binary.BigEndian, uint16(len(payload)))
+	frame.Write([]byte{ipv6NextICMPv6, ipv6NdpHopLimit})
+	frame.Write(srcIP.To16())
+	frame.Write(dstIP.To16())
+	frame.Write(payload)
+	return frame.Bytes()
+}
+
+func sendNdpPacket(buf []byte, dev string) error {
+	socket, err := createSocket(syscall.ETH_P_IPV6)
+	if err != nil {
+		logrus.Error("failed to create raw ndp socket: ", err)
+		return err
+	}
+	defer syscall.Close(socket)
+
+	sockAddr, err := getAddress(dev, syscall.ETH_P_IPV6)
+	if err != nil {
+		logrus.Error("failed to bind ndp socket address: ", err)
+		return err
+	}
+	return syscall.Sendto(socket, buf, 0, sockAddr)
+}
+
+// SendUnsolicitedNeighborAdvertisement announces srcMac as the owner of srcIP to all nodes of the vlan
+func SendUnsolicitedNeighborAdvertisement(srcMac net.HardwareAddr, srcIP net.IP, dev string, vlanId int, outer ...VlanTag) error {
+	buf := createNdpPacket(ICMPV6_NEIGHBOR_ADVERTISEMENT, NA_FLAG_OVERRIDE,
+		srcMac, multicastHwAddr(ipv6AllNodes), srcIP, ipv6AllNodes, srcIP, vlanId)
+
+	logrus.WithField("src", srcIP).Debug("send unsolicited neighbor advertisement")
+	return sendNdpPacket(pushTags(buf, outer), dev)
+}
+
+// SendNeighborSolicitation asks for the link-layer address of dstIP, the ipv6
+// counterpart of SendArpRequest
+func SendNeighborSolicitation(srcMac net.HardwareAddr, srcIP, dstIP net.IP, dev string, vlanId int, outer ...VlanTag) error {
+	snAddr, snHwAddr := solicitedNodeAddress(dstIP)
+	buf := createNdpPacket(ICMPV6_NEIGHBOR_SOLICITATION, 0,
+		srcMac, snHwAddr, srcIP, snAddr, dstIP, vlanId)
+
+	logrus.WithField("src", srcIP).WithField("dst", dstIP).Debug("send neighbor solicitation")
+	return sendNdpPacket(pushTags(buf, outer), dev)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/vishvananda/netlink"
@@ -62,6 +63,58 @@ func PreferredParentEth() (string, error) {
 	return "", fmt.Errorf("cannot find preferred ethernet")
 }
 
+// SubnetSelector prefixes a parent eth selector picking the interface which
+// holds an address in the given subnet, e.g. subnet:10.1.0.0/16
+const SubnetSelector = "subnet:"
+
+// FindParentEth resolves a parent eth selector, an interface name or a
+// subnet selector, a vlan device resolves to its parent like the default
+// parent eth
+func FindParentEth(selector string) (string, error) {
+	if !strings.HasPrefix(selector, SubnetSelector) {
+		return FindParentFromVlan(selector)
+	}
+
+	_, subnet, err := net.ParseCIDR(strings.TrimPrefix(selector, SubnetSelector))
+	if err != nil {
+		return "", err
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ip, _, _ := net.ParseCIDR(addr.String())
+			if ip != nil && subnet.Contains(ip) {
+				return FindParentFromVlan(iface.Name)
+			}
+		}
+	}
+	return "", fmt.Errorf("cannot find interface holding subnet %s", subnet)
+}
+
+func FindIPv4Address(dev string) (net.IP, error) {
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("cannot find ipv4 address on device %q", dev)
+	}
+	return addrs[0].IP, nil
+}
+
 func CreateVethPeer(name string) ([]*netlink.Veth, error) {
 	if _, err := netlink.LinkByName(name); err != nil {
 		if err := netlink.LinkAdd(
@@ -98,6 +151,12 @@ func DelVethPeer(name string) error {
 }
 
 func CreateVlan(parentName string, vlanId int, vlanName string) (*netlink.Vlan, error) {
+	return CreateVlanWithProtocol(parentName, vlanId, VLAN_PROTOCOL_8021Q, vlanName)
+}
+
+// CreateVlanWithProtocol creates a vlan device pushing a tag of protocol,
+// an 802.1ad one is the outer device of a QinQ vlan
+func CreateVlanWithProtocol(parentName string, vlanId int, protocol VlanProtocol, vlanName string) (*netlink.Vlan, error) {
 	parent, err := netlink.LinkByName(parentName)
 	if err != nil {
 		return nil, err
@@ -105,7 +164,14 @@ func CreateVlan(parentName string, vlanId int, vlanName string) (*netlink.Vlan,
 
 	if link, err := netlink.LinkByName(vlanName); err == nil {
 		if vlan, ok := link.(*netlink.Vlan); ok {
-			if vlan.ParentIndex == parent.Attrs().Index && vlan.VlanId == vlanId {
+			existing, err := linkVlanProtocol(vlan)
+			if err != nil {
+				return nil, err
+			}
+			// kernels before 3.10 do not report the protocol, it is 802.1Q then
+			sameProtocol := existing == protocol ||
+				existing == VLAN_PROTOCOL_UNKNOWN && protocol == VLAN_PROTOCOL_8021Q
+			if vlan.ParentIndex == parent.Attrs().Index && vlan.VlanId == vlanId && sameProtocol {
 				logrus.WithField("vlan", vlanName).Debug("find exist vlan device")
 				return vlan, nil // VLAN设备已经存在
 			}
@@ -113,10 +179,7 @@ func CreateVlan(parentName string, vlanId int, vlanName string) (*netlink.Vlan,
 		return nil, errors.New("another interface exists, but cannot be used")
 	}
 
-	if err = netlink.LinkAdd(&netlink.Vlan{
-		LinkAttrs: netlink.LinkAttrs{Name: vlanName, ParentIndex: parent.Attrs().Index},
-		VlanId:    vlanId,
-	}); err != nil {
+	if err = linkAddVlan(parent, vlanId, protocol, vlanName); err != nil {
 		return nil, err
 	}
 	logrus.WithField("vlan", vlanName).Info("successfully create vlan device")
@@ -128,6 +191,58 @@ func CreateVlan(parentName string, vlanId int, vlanName string) (*netlink.Vlan,
 	return vlan.(*netlink.Vlan), nil
 }
 
+// CreateMacvlan creates a bridge mode macvlan named name on parent, the
+// macvlan is left down for the caller to move it into a container
+func CreateMacvlan(parent netlink.Link, name string, mac net.HardwareAddr) (*netlink.Macvlan, error) {
+	if _, err := netlink.LinkByName(name); err == nil {
+		if err := DestroyDevice(name); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := netlink.LinkAdd(&netlink.Macvlan{
+		LinkAttrs: netlink.LinkAttrs{Name: name, ParentIndex: parent.Attrs().Index},
+		Mode:      netlink.MACVLAN_MODE_BRIDGE,
+	}); err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"macvlan": name, "parent": parent.Attrs().Name}).Info("successfully create macvlan device")
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := Set(link, MacSetter(mac)); err != nil {
+		DestroyDevice(name)
+		return nil, err
+	}
+	return link.(*netlink.Macvlan), nil
+}
+
+// CreateIpvlan creates an ipvlan of the given mode named name on parent, its
+// slaves share the mac of parent
+func CreateIpvlan(parent netlink.Link, name string, mode netlink.IPVlanMode) (*netlink.IPVlan, error) {
+	if _, err := netlink.LinkByName(name); err == nil {
+		if err := DestroyDevice(name); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := netlink.LinkAdd(&netlink.IPVlan{
+		LinkAttrs: netlink.LinkAttrs{Name: name, ParentIndex: parent.Attrs().Index},
+		Mode:      mode,
+	}); err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"ipvlan": name, "parent": parent.Attrs().Name, "mode": mode}).Info("successfully create ipvlan device")
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return link.(*netlink.IPVlan), nil
+}
+
 func CreateBridge(bridgeName string) (*netlink.Bridge, error) {
 	if iface, err := netlink.LinkByName(bridgeName); err == nil {
 		if bridge, ok := iface.(*netlink.Bridge); ok {
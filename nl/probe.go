@@ -0,0 +1,249 @@
+package nl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	nlk "github.com/vishvananda/netlink/nl"
+)
+
+const (
+	PACKET_AUXDATA       = 8
+	PACKET_MR_UNICAST    = 3
+	TP_STATUS_VLAN_VALID = 1 << 4
+
+	ethHeaderSize = 14
+	arpBodySize   = 28
+	// status, len, snaplen, mac, net, vlan_tci, vlan_tpid of struct tpacket_auxdata
+	auxdataVlanTciOffset = 16
+
+	recvTimeout = 100 * time.Millisecond
+)
+
+// arpMessage is an arp packet received on a vlan
+type arpMessage struct {
+	Op         uint16
+	SndrHwAddr net.HardwareAddr
+	SndrIpAddr net.IP
+	RcptIpAddr net.IP
+}
+
+// arpListener receives the arp packets of one vlan on the parent eth. The
+// socket taps every frame before the kernel hands it to a vlan device, the
+// stripped 802.1Q tag is read from the packet auxdata.
+type arpListener struct {
+	fd       int
+	vlanId   int
+	sockAddr syscall.Sockaddr
+}
+
+// packetMreq is struct packet_mreq of linux/if_packet.h
+type packetMreq struct {
+	Ifindex int32
+	Type    uint16
+	Alen    uint16
+	Address [8]byte
+}
+
+// addUnicastMembership makes the parent eth accept frames sent to mac, the
+// replies to a container mac it has not learned yet would be dropped by a
+// non promiscuous parent eth
+func addUnicastMembership(fd, ifindex int, mac net.HardwareAddr) error {
+	mreq := packetMreq{Ifindex: int32(ifindex), Type: PACKET_MR_UNICAST, Alen: uint16(len(mac))}
+	copy(mreq.Address[:], mac)
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP,
+		uintptr(unsafe.Pointer(&mreq)), unsafe.Sizeof(mreq), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// listenArp listens on the parent eth for the arp packets of the vlan, the
+// parent eth accepts frames sent to mac until the listener is closed
+func listenArp(dev string, vlanId int, mac net.HardwareAddr) (*arpListener, error) {
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := createSocket(syscall.ETH_P_ALL)
+	if err != nil {
+		logrus.Error("failed to create raw arp socket: ", err)
+		return nil, err
+	}
+
+	l := &arpListener{
+		fd:     fd,
+		vlanId: vlanId,
+		sockAddr: &syscall.SockaddrLinklayer{
+			Protocol: htons(syscall.ETH_P_ALL),
+			Ifindex:  link.Attrs().Index,
+		},
+	}
+
+	tv := syscall.NsecToTimeval(recvTimeout.Nanoseconds())
+	for _, setup := range []func() error{
+		func() error { return syscall.Bind(fd, l.sockAddr) },
+		func() error { return addUnicastMembership(fd, link.Attrs().Index, mac) },
+		func() error { return syscall.SetsockoptInt(fd, syscall.SOL_PACKET, PACKET_AUXDATA, 1) },
+		func() error { return syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv) },
+	} {
+		if err := setup(); err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *arpListener) Close() error {
+	return syscall.Close(l.fd)
+}
+
+func (l *arpListener) Send(packet *arpPacket) error {
+	buf, err := buildArpPacketBuffer(packet)
+	if err != nil {
+		return err
+	}
+	return syscall.Sendto(l.fd, buf, 0, l.sockAddr)
+}
+
+// Next returns the next arp packet received on the vlan, nil once deadline passed
+func (l *arpListener) Next(deadline time.Time) (*arpMessage, error) {
+	buf := make([]byte, 1514)
+	oob := make([]byte, syscall.CmsgSpace(32))
+
+	for time.Now().Before(deadline) {
+		n, oobn, _, from, err := syscall.Recvmsg(l.fd, buf, oob, 0)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			return nil, err
+		}
+		if sa, ok := from.(*syscall.SockaddrLinklayer); ok && sa.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+
+		frame := buf[:n]
+		vlanId := -1
+		if len(frame) >= ethHeaderSize+4 && binary.BigEndian.Uint16(frame[12:14]) == ETH_8021Q_TPID {
+			// tag not stripped by the kernel
+			vlanId = int(binary.BigEndian.Uint16(frame[14:16]) & 0xfff)
+			frame = append(frame[:12:12], frame[16:]...)
+		} else if tci, ok := vlanTciFromAuxdata(oob[:oobn]); ok {
+			vlanId = int(tci & 0xfff)
+		}
+		if vlanId != l.vlanId {
+			continue
+		}
+
+		if len(frame) < ethHeaderSize+arpBodySize || binary.BigEndian.Uint16(frame[12:14]) != syscall.ETH_P_ARP {
+			continue
+		}
+		arp := frame[ethHeaderSize:]
+		return &arpMessage{
+			Op:         binary.BigEndian.Uint16(arp[6:8]),
+			SndrHwAddr: net.HardwareAddr(append([]byte{}, arp[8:14]...)),
+			SndrIpAddr: net.IP(append([]byte{}, arp[14:18]...)),
+			RcptIpAddr: net.IP(append([]byte{}, arp[24:28]...)),
+		}, nil
+	}
+	return nil, nil
+}
+
+func vlanTciFromAuxdata(oob []byte) (uint16, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level != syscall.SOL_PACKET || msg.Header.Type != PACKET_AUXDATA || len(msg.Data) < auxdataVlanTciOffset+2 {
+			continue
+		}
+		status := nlk.NativeEndian().Uint32(msg.Data[0:4])
+		if status&TP_STATUS_VLAN_VALID == 0 {
+			return 0, false
+		}
+		return nlk.NativeEndian().Uint16(msg.Data[auxdataVlanTciOffset:]), true
+	}
+	return 0, false
+}
+
+// ProbeArp sends RFC 5227 arp probes for ip on the vlan, and returns the mac
+// of whoever claims the address, nil if no conflict is seen within wait after
+// the last probe
+func ProbeArp(srcMac net.HardwareAddr, ip net.IP, dev string, vlanId int, count int, interval, wait time.Duration) (net.HardwareAddr, error) {
+	l, err := listenArp(dev, vlanId, srcMac)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	conflict := func(msg *arpMessage) bool {
+		if bytes.Equal(msg.SndrHwAddr, srcMac) {
+			return false
+		}
+		// someone owns the address, or probes for it at the same time
+		return msg.SndrIpAddr.Equal(ip.To4()) ||
+			(msg.Op == ARP_REQUEST && msg.SndrIpAddr.Equal(net.IPv4zero.To4()) && msg.RcptIpAddr.Equal(ip.To4()))
+	}
+
+	for i := 0; i < count; i++ {
+		logrus.WithFields(logrus.Fields{"ip": ip, "vlan": vlanId}).Debug("send arp probe")
+		if err := l.Send(createArpPacket(ARP_REQUEST, srcMac, srcMac, net.IPv4zero, ip, vlanId)); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(interval)
+		if i == count-1 {
+			deadline = time.Now().Add(wait)
+		}
+		for {
+			msg, err := l.Next(deadline)
+			if err != nil {
+				return nil, err
+			}
+			if msg == nil {
+				break
+			}
+			if conflict(msg) {
+				return msg.SndrHwAddr, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// ResolveArp sends an arp request for dstIP on the vlan and waits for the
+// reply, it returns nil if nothing answered within timeout
+func ResolveArp(srcMac net.HardwareAddr, srcIP, dstIP net.IP, dev string, vlanId int, timeout time.Duration) (net.HardwareAddr, error) {
+	l, err := listenArp(dev, vlanId, srcMac)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	logrus.WithField("src", srcIP).WithField("dst", dstIP).Debug("send arp request")
+	if err := l.Send(createArpPacket(ARP_REQUEST, srcMac, srcMac, srcIP, dstIP, vlanId)); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		msg, err := l.Next(deadline)
+		if err != nil || msg == nil {
+			return nil, err
+		}
+		if msg.Op == ARP_REPLY && msg.SndrIpAddr.Equal(dstIP.To4()) {
+			return msg.SndrHwAddr, nil
+		}
+	}
+}
@@ -18,6 +18,15 @@ func MacSetter(mac net.HardwareAddr) networkSetter {
 	}
 }
 
+func MtuSetter(mtu int) networkSetter {
+	return func(link netlink.Link) error {
+		logrus.WithFields(
+			logrus.Fields{"name": link.Attrs().Name, "mtu": mtu},
+		).Debug("set eth mtu")
+		return netlink.LinkSetMTU(link, mtu)
+	}
+}
+
 func UpSetter() networkSetter {
 	return func(link netlink.Link) error {
 		if link.Attrs().Flags&net.FlagUp == 1 {
@@ -0,0 +1,96 @@
+package nl
+
+import (
+	"encoding/binary"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	nlk "github.com/vishvananda/netlink/nl"
+)
+
+// VlanProtocol is the ethertype of the tag a vlan device pushes, the vendored
+// netlink only creates 802.1Q vlan devices
+type VlanProtocol uint16
+
+const (
+	VLAN_PROTOCOL_UNKNOWN VlanProtocol = 0
+	VLAN_PROTOCOL_8021Q   VlanProtocol = 0x8100
+	VLAN_PROTOCOL_8021AD  VlanProtocol = 0x88A8
+)
+
+// linkAddVlan creates a vlan device on the parent, pushing a tag of protocol
+func linkAddVlan(parent netlink.Link, vlanId int, protocol VlanProtocol, vlanName string) error {
+	req := nlk.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+
+	msg := nlk.NewIfInfomsg(syscall.AF_UNSPEC)
+	req.AddData(msg)
+	req.AddData(nlk.NewRtAttr(syscall.IFLA_LINK, nlk.Uint32Attr(uint32(parent.Attrs().Index))))
+	req.AddData(nlk.NewRtAttr(syscall.IFLA_IFNAME, nlk.ZeroTerminated(vlanName)))
+
+	linkInfo := nlk.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nlk.NewRtAttrChild(linkInfo, nlk.IFLA_INFO_KIND, nlk.NonZeroTerminated("vlan"))
+	data := nlk.NewRtAttrChild(linkInfo, nlk.IFLA_INFO_DATA, nil)
+	nlk.NewRtAttrChild(data, nlk.IFLA_VLAN_ID, nlk.Uint16Attr(uint16(vlanId)))
+	// the protocol goes in network byte order
+	proto := make([]byte, 2)
+	binary.BigEndian.PutUint16(proto, uint16(protocol))
+	nlk.NewRtAttrChild(data, nlk.IFLA_VLAN_PROTOCOL, proto)
+	req.AddData(linkInfo)
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// linkVlanProtocol returns the protocol of the tag the vlan device pushes,
+// VLAN_PROTOCOL_UNKNOWN on kernels before 3.10 which do not report it
+func linkVlanProtocol(vlan netlink.Link) (VlanProtocol, error) {
+	req := nlk.NewNetlinkRequest(syscall.RTM_GETLINK, syscall.NLM_F_ACK)
+
+	msg := nlk.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(vlan.Attrs().Index)
+	req.AddData(msg)
+
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK)
+	if err != nil {
+		return VLAN_PROTOCOL_UNKNOWN, err
+	}
+	for _, m := range msgs {
+		attrs, err := nlk.ParseRouteAttr(m[syscall.SizeofIfInfomsg:])
+		if err != nil {
+			return VLAN_PROTOCOL_UNKNOWN, err
+		}
+		data, err := nestedAttr(attrs, syscall.IFLA_LINKINFO, nlk.IFLA_INFO_DATA)
+		if err != nil || data == nil {
+			return VLAN_PROTOCOL_UNKNOWN, err
+		}
+		for _, attr := range data {
+			if attr.Attr.Type == nlk.IFLA_VLAN_PROTOCOL && len(attr.Value) >= 2 {
+				return VlanProtocol(binary.BigEndian.Uint16(attr.Value[0:2])), nil
+			}
+		}
+	}
+	return VLAN_PROTOCOL_UNKNOWN, nil
+}
+
+// nestedAttr walks down the nested attributes of types, nil if one is missing
+func nestedAttr(attrs []syscall.NetlinkRouteAttr, types ...int) ([]syscall.NetlinkRouteAttr, error) {
+	for _, t := range types {
+		var found []syscall.NetlinkRouteAttr
+		for _, attr := range attrs {
+			if int(attr.Attr.Type) != t {
+				continue
+			}
+			nested, err := nlk.ParseRouteAttr(attr.Value)
+			if err != nil {
+				return nil, err
+			}
+			found = nested
+			break
+		}
+		if found == nil {
+			return nil, nil
+		}
+		attrs = found
+	}
+	return attrs, nil
+}
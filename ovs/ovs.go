@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -85,6 +88,23 @@ func ExistsBridge(bridge string) error {
 	return nil
 }
 
+func SetFailMode(bridge, mode string) error {
+	args := []string{"set-fail-mode", bridge, mode}
+	if _, err := Raw("ovs-vsctl", args...); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetProtocols sets the openflow versions the bridge speaks
+func SetProtocols(bridge string, protocols ...string) error {
+	args := []string{"set", "bridge", bridge, "protocols=" + strings.Join(protocols, ",")}
+	if _, err := Raw("ovs-vsctl", args...); err != nil {
+		return err
+	}
+	return nil
+}
+
 func ExistsPort(port string) error {
 	args := []string{"port-to-br", port}
 	if _, err := Raw("ovs-vsctl", args...); err != nil {
@@ -93,6 +113,28 @@ func ExistsPort(port string) error {
 	return nil
 }
 
+// PortBridge returns the bridge the port is attached to
+func PortBridge(port string) (string, error) {
+	output, err := Raw("ovs-vsctl", "port-to-br", port)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// PortTag returns the access vlan of the port, 0 if it has none
+func PortTag(port string) (int, error) {
+	output, err := Raw("ovs-vsctl", "get", "port", port, "tag")
+	if err != nil {
+		return 0, err
+	}
+	tag := strings.TrimSpace(string(output))
+	if tag == "[]" {
+		return 0, nil
+	}
+	return strconv.Atoi(tag)
+}
+
 func AddVxlanPort(bridge string, port string) (string, error) {
 	args := []string{"add-port", bridge, port, "--", "set", "interface", port, "type=vxlan", "options:remote_ip=flow", "options:key=flow"}
 	if _, err := Raw("ovs-vsctl", args...); err != nil {
@@ -122,6 +164,15 @@ func AddPort(bridge string, port string, options ...string) (string, error) {
 	}
 }
 
+// AddPortTrunk makes the port trunk vlanId tagged, its own tag stays untagged
+func AddPortTrunk(port string, vlanId int) error {
+	args := []string{"set", "port", port, "vlan_mode=native-untagged", "--", "add", "port", port, "trunks", strconv.Itoa(vlanId)}
+	if _, err := Raw("ovs-vsctl", args...); err != nil {
+		return err
+	}
+	return nil
+}
+
 func DelPort(bridge, port string) error {
 	args := []string{"del-port", bridge, port}
 	if _, err := Raw("ovs-vsctl", args...); err != nil {
@@ -138,6 +189,48 @@ func AddFlows(bridge, flowFile string) error {
 	return nil
 }
 
+func AddFlowsFromLines(bridge string, flows []string) error {
+	f, err := ioutil.TempFile("", "flows")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(strings.Join(flows, "\n") + "\n")
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return AddFlows(bridge, f.Name())
+}
+
+// ReplaceFlows deletes the flows matching del and adds flows in one
+// bundle, the switch applies both or neither so traffic never sees the
+// flows half replaced. It needs OpenFlow 1.4 on the bridge.
+func ReplaceFlows(bridge, del string, flows []string) error {
+	f, err := ioutil.TempFile("", "flows")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	lines := []string{"delete " + del}
+	for _, flow := range flows {
+		lines = append(lines, "add "+flow)
+	}
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	args := []string{"--bundle", "add-flows", "-OOpenFlow14", bridge, f.Name()}
+	if _, err := Raw("ovs-ofctl", args...); err != nil {
+		return err
+	}
+	return nil
+}
+
 func DelFlows(bridge, del string) error {
 	args := []string{"del-flows", bridge}
 	if del != "" {
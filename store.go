@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/docker/libkv"
+	"github.com/docker/libkv/store"
+	"github.com/omega/vlan-netplugin/zookeeper"
+)
+
+const (
+	defaultBoltBucket = "vlan-netplugin"
+
+	scopeGlobal = "global"
+	scopeLocal  = "local"
+)
+
+// storeFlags returns the flags to connect the cluster store, shared by every
+// command talking to the store
+func storeFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "scope",
+			EnvVar: "NP_SCOPE",
+			Value:  scopeGlobal,
+			Usage:  "Set the driver scope (options: global, local), local keeps the records in --local-store instead of the cluster store",
+		},
+		cli.StringFlag{
+			Name:   "cluster-store",
+			EnvVar: "NP_CLUSTER_STORE",
+			Value:  "zk://localhost:2181",
+			Usage:  "Set the cluster store",
+		},
+		cli.StringFlag{
+			Name:   "local-store",
+			EnvVar: "NP_LOCAL_STORE",
+			Value:  "/var/lib/vlan-netplugin/local.db",
+			Usage:  "Set the database file of the local scope store",
+		},
+		cli.BoolFlag{
+			Name:   "store-tls",
+			EnvVar: "NP_STORE_TLS",
+			Usage:  "Connect the cluster store with tls, implied by --store-ca or --store-cert",
+		},
+		cli.StringFlag{
+			Name:   "store-ca",
+			EnvVar: "NP_STORE_CA",
+			Usage:  "Set the ca certificate to verify the cluster store, defaults to the system roots",
+		},
+		cli.StringFlag{
+			Name:   "store-cert",
+			EnvVar: "NP_STORE_CERT",
+			Usage:  "Set the client certificate for the cluster store",
+		},
+		cli.StringFlag{
+			Name:   "store-key",
+			EnvVar: "NP_STORE_KEY",
+			Usage:  "Set the client key for the cluster store",
+		},
+		cli.StringFlag{
+			Name:   "store-username",
+			EnvVar: "NP_STORE_USERNAME",
+			Usage:  "Set the username for the cluster store, zookeeper uses it as digest acl",
+		},
+		cli.StringFlag{
+			Name:   "store-password",
+			EnvVar: "NP_STORE_PASSWORD",
+			Usage:  "Set the password for the cluster store",
+		},
+		cli.DurationFlag{
+			Name:   "store-connection-timeout",
+			EnvVar: "NP_STORE_CONNECTION_TIMEOUT",
+			Usage:  "Set the connect timeout (zookeeper), request timeout (etcd) or wait time (consul) of the cluster store",
+		},
+		cli.BoolTFlag{
+			Name:   "store-cache",
+			EnvVar: "NP_STORE_CACHE",
+			Usage:  "Serve network and endpoint records from a local cache while the cluster store is unreachable, writes are queued and replayed, never for boltdb",
+		},
+		cli.DurationFlag{
+			Name:   "store-session-timeout",
+			EnvVar: "NP_STORE_SESSION_TIMEOUT",
+			Value:  10 * time.Second,
+			Usage:  "Set the zookeeper session timeout",
+		},
+	}
+}
+
+// storeConfig builds the libkv config from the store flags
+func storeConfig(c *cli.Context) (*store.Config, error) {
+	config := &store.Config{
+		ConnectionTimeout: c.Duration("store-connection-timeout"),
+		Username:          c.String("store-username"),
+		Password:          c.String("store-password"),
+	}
+
+	if !c.Bool("store-tls") && c.String("store-ca") == "" && c.String("store-cert") == "" {
+		return config, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if ca := c.String("store-ca"); ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", ca)
+		}
+	}
+	if cert := c.String("store-cert"); cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, c.String("store-key"))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	config.TLS = tlsConfig
+	config.ClientTLS = &store.ClientTLSConfig{
+		CertFile:   c.String("store-cert"),
+		KeyFile:    c.String("store-key"),
+		CACertFile: c.String("store-ca"),
+	}
+	return config, nil
+}
+
+// newStore connects to the cluster store given as <backend>://<host1>,<host2>/<prefix>,
+// boltdb takes the database file as path instead, e.g. boltdb:///var/lib/vlan-netplugin/store.db?bucket=vlan.
+// In local scope it opens the boltdb file given by --local-store.
+// It returns the store and the key prefix under which the driver keeps its records.
+func newStore(c *cli.Context) (store.Store, string, error) {
+	clusterStore := c.String("cluster-store")
+	switch c.String("scope") {
+	case scopeGlobal:
+	case scopeLocal:
+		if err := os.MkdirAll(filepath.Dir(c.String("local-store")), 0755); err != nil {
+			return nil, "", err
+		}
+		clusterStore = "boltdb://" + c.String("local-store")
+	default:
+		return nil, "", fmt.Errorf("unknown scope %q", c.String("scope"))
+	}
+
+	u, err := url.Parse(clusterStore)
+	if err != nil {
+		return nil, "", err
+	}
+
+	config, err := storeConfig(c)
+	if err != nil {
+		return nil, "", err
+	}
+
+	backend := store.Backend(u.Scheme)
+	switch backend {
+	case store.ZK:
+		s, err := zookeeper.New(endpoints(u), config, c.Duration("store-session-timeout"))
+		return s, u.Path, err
+
+	case store.ETCD:
+		s, err := libkv.NewStore(backend, endpoints(u), config)
+		return s, u.Path, err
+
+	case store.CONSUL:
+		// libkv does not pass credentials to consul, the api client picks
+		// them up from the environment
+		if config.Username != "" {
+			os.Setenv("CONSUL_HTTP_AUTH", config.Username+":"+config.Password)
+		}
+
+		// the consul client only talks to one agent, take the first that answers
+		var lastErr error
+		for _, endpoint := range endpoints(u) {
+			s, err := libkv.NewStore(backend, []string{endpoint}, config)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if _, err := s.Exists(strings.Trim(u.Path, "/")); err != nil {
+				logrus.WithFields(logrus.Fields{"endpoint": endpoint, "err": err}).Warn("consul agent unreachable, try next")
+				s.Close()
+				lastErr = err
+				continue
+			}
+			return s, u.Path, nil
+		}
+		return nil, "", lastErr
+
+	case store.BOLTDB:
+		if u.Path == "" {
+			return nil, "", fmt.Errorf("boltdb store needs a database file, e.g. boltdb:///var/lib/vlan-netplugin/store.db")
+		}
+		config.Bucket = u.Query().Get("bucket")
+		if config.Bucket == "" {
+			config.Bucket = defaultBoltBucket
+		}
+		s, err := libkv.NewStore(backend, []string{u.Path}, config)
+		return s, "", err
+	}
+
+	return nil, "", fmt.Errorf("unsupported cluster store backend %q", u.Scheme)
+}
+
+// storeCache tells whether to cache the records of the cluster store, a
+// boltdb file is never unreachable and cannot be watched
+func storeCache(c *cli.Context) bool {
+	if !c.Bool("store-cache") {
+		return false
+	}
+	u, err := url.Parse(c.String("cluster-store"))
+	return err == nil && store.Backend(u.Scheme) != store.BOLTDB
+}
+
+func endpoints(u *url.URL) []string {
+	var endpoints []string
+	for _, host := range strings.Split(u.Host, ",") {
+		if host != "" {
+			endpoints = append(endpoints, host)
+		}
+	}
+	return endpoints
+}